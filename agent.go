@@ -0,0 +1,200 @@
+package reversehttp
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// AgentState describes the connection of an Agent to its server.
+type AgentState int
+
+const (
+	// StateConnecting means the Agent is making its upgrade request.
+	StateConnecting AgentState = iota
+	// StateConnected means the Agent is serving requests from the server.
+	StateConnected
+	// StateDisconnected means the Agent is waiting before reconnecting.
+	StateDisconnected
+	// StateStopped means the Agent has stopped because its context ended.
+	StateStopped
+)
+
+func (s AgentState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	case StateStopped:
+		return "stopped"
+	}
+	return "AgentState(" + strconv.Itoa(int(s)) + ")"
+}
+
+const (
+	defaultMinBackoff = time.Second
+	defaultMaxBackoff = time.Minute
+)
+
+// Agent keeps a Reverse HTTP connection to a server open, serving the
+// server's requests with Handler and reconnecting whenever the connection
+// fails or is closed by the server.
+//
+// Reconnection attempts are delayed with jittered exponential backoff, which
+// is reset once a connection has been established. A server that rejects the
+// upgrade with 503 Service Unavailable and a Retry-After header is not retried
+// before the time it asked for.
+type Agent struct {
+	// URL is the address the upgrade requests are made to.
+	URL string
+
+	// Handler serves the requests made by the server.
+	Handler http.Handler
+
+	// Dialer makes the upgrade requests. If nil, the zero Dialer is used.
+	Dialer *Dialer
+
+	// MinBackoff and MaxBackoff bound the delay between connection attempts.
+	// They default to one second and one minute.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// OnStateChange, if not nil, is called whenever the state of the Agent
+	// changes, along with the error that caused the change, if any.
+	OnStateChange func(state AgentState, err error)
+}
+
+// Run connects to the server and serves its requests until ctx is done, at
+// which point the current connection is closed and ctx.Err() is returned.
+func (a *Agent) Run(ctx context.Context) error {
+	b := newBackoff(a.MinBackoff, a.MaxBackoff)
+	for {
+		a.setState(StateConnecting, nil)
+		resp, retryAfter, err := connect(ctx, a.Dialer, a.URL)
+		if err == nil {
+			a.setState(StateConnected, nil)
+			b.reset()
+			err = ReverseResponseContext(ctx, resp, a.Handler)
+		}
+
+		if ctx.Err() != nil {
+			a.setState(StateStopped, ctx.Err())
+			return ctx.Err()
+		}
+		a.setState(StateDisconnected, err)
+
+		if !b.wait(ctx, retryAfter) {
+			a.setState(StateStopped, ctx.Err())
+			return ctx.Err()
+		}
+	}
+}
+
+func (a *Agent) setState(state AgentState, err error) {
+	if a.OnStateChange != nil {
+		a.OnStateChange(state, err)
+	}
+}
+
+// connect makes the upgrade request with d, or the zero Dialer if d is nil.
+// If the server rejected it and asked to be retried later, the requested
+// delay is returned along with the error.
+func connect(ctx context.Context, d *Dialer, url string) (*http.Response, time.Duration, error) {
+	if d == nil {
+		d = new(Dialer)
+	}
+
+	resp, err := d.upgrade(ctx, url)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if err := d.check(resp); err != nil {
+		var retryAfter time.Duration
+		if resp.StatusCode == http.StatusServiceUnavailable {
+			retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+		}
+		return nil, retryAfter, err
+	}
+	return resp, 0, nil
+}
+
+// backoff is the jittered exponential backoff between connection attempts
+// shared by Agents and Listeners.
+type backoff struct {
+	min, max time.Duration
+	next     time.Duration
+}
+
+// newBackoff returns a backoff between min and max, which default to one
+// second and one minute.
+func newBackoff(min, max time.Duration) *backoff {
+	if min <= 0 {
+		min = defaultMinBackoff
+	}
+	if max < min {
+		max = defaultMaxBackoff
+		if max < min {
+			max = min
+		}
+	}
+	return &backoff{min: min, max: max, next: min}
+}
+
+// reset makes the next wait the shortest again, once a connection succeeded.
+func (b *backoff) reset() {
+	b.next = b.min
+}
+
+// wait waits before the next attempt, for at least retryAfter, and doubles
+// the delay of the one after. It returns false if ctx is done first.
+func (b *backoff) wait(ctx context.Context, retryAfter time.Duration) bool {
+	delay := jitter(b.next)
+	if retryAfter > delay {
+		delay = retryAfter
+	}
+	b.next *= 2
+	if b.next > b.max {
+		b.next = b.max
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// jitter returns a random duration in [d/2, d].
+func jitter(d time.Duration) time.Duration {
+	half := int64(d / 2)
+	return time.Duration(half + rand.Int63n(int64(d)-half+1))
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which is either
+// a number of seconds or an HTTP date. It returns 0 if v is invalid.
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
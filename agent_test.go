@@ -0,0 +1,115 @@
+package reversehttp
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAgentStateString(t *testing.T) {
+	expect(t, "connecting", StateConnecting.String())
+	expect(t, "connected", StateConnected.String())
+	expect(t, "disconnected", StateDisconnected.String())
+	expect(t, "stopped", StateStopped.String())
+	expect(t, "AgentState(42)", AgentState(42).String())
+}
+
+func TestJitter(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		d := jitter(time.Second)
+		if d < time.Second/2 || d > time.Second {
+			t.Errorf("jitter out of range: %v", d)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	expect(t, time.Duration(0), parseRetryAfter(""))
+	expect(t, time.Duration(0), parseRetryAfter("soon"))
+	expect(t, time.Duration(0), parseRetryAfter("-3"))
+	expect(t, 120*time.Second, parseRetryAfter("120"))
+	expect(t, time.Duration(0), parseRetryAfter("Wed, 21 Oct 2015 07:28:00 GMT"))
+
+	d := parseRetryAfter(time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	if d < 59*time.Minute || d > time.Hour {
+		t.Errorf("unexpected retry after: %v", d)
+	}
+}
+
+func TestAgent(t *testing.T) {
+	hub := new(Hub)
+	connected := watchHub(hub)
+
+	// reject the first upgrade, as an overloaded server would
+	var mu sync.Mutex
+	rejected := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		reject := !rejected
+		rejected = true
+		mu.Unlock()
+
+		if reject {
+			w.Header().Set("Retry-After", "0")
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		hub.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	states := make(chan AgentState, 100)
+	agent := &Agent{
+		URL: srv.URL,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("hello world\n"))
+		}),
+		Dialer: &Dialer{
+			Client: srv.Client(),
+			Header: http.Header{ClientIDHeader: {"agent"}},
+		},
+		MinBackoff: time.Millisecond,
+		MaxBackoff: 10 * time.Millisecond,
+		OnStateChange: func(state AgentState, err error) {
+			states <- state
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error)
+	go func() {
+		result <- agent.Run(ctx)
+	}()
+
+	// the rejected attempt is retried
+	expect(t, "agent", <-connected)
+	for _, state := range []AgentState{StateConnecting, StateDisconnected, StateConnecting, StateConnected} {
+		expect(t, state, <-states)
+	}
+
+	resp, err := hub.Client("agent").Get("http://agent/")
+	expect(t, nil, err)
+	b, err := ioutil.ReadAll(resp.Body)
+	expect(t, nil, err)
+	expect(t, "hello world\n", string(b))
+
+	// closing the connection makes the agent reconnect
+	hub.Close()
+	expect(t, "agent", <-connected)
+	for _, state := range []AgentState{StateDisconnected, StateConnecting, StateConnected} {
+		expect(t, state, <-states)
+	}
+
+	cancel()
+	select {
+	case err := <-result:
+		expect(t, context.Canceled, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent did not stop")
+	}
+	expect(t, StateStopped, <-states)
+}
@@ -0,0 +1,186 @@
+package reversehttp
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Identity describes a reverse client that has been authenticated.
+type Identity struct {
+	// ID names the client. A Hub registers the client under this ID.
+	ID string
+
+	// Method is the authentication method that established the identity,
+	// such as "bearer", "basic", "hmac" or "tls".
+	Method string
+}
+
+// Authenticator checks the credentials of Reverse HTTP upgrade requests
+// before their connections are accepted.
+type Authenticator interface {
+	// Authenticate returns the identity of the client making the upgrade
+	// request r. It returns ErrUnauthorized when r carries no valid
+	// credentials, and ErrForbidden, or any other error, when the client is
+	// not allowed to connect.
+	Authenticate(r *http.Request) (Identity, error)
+}
+
+// AuthenticatorFunc is an adapter to allow the use of ordinary functions as
+// Authenticators.
+type AuthenticatorFunc func(r *http.Request) (Identity, error)
+
+// Authenticate calls f(r).
+func (f AuthenticatorFunc) Authenticate(r *http.Request) (Identity, error) {
+	return f(r)
+}
+
+var (
+	// ErrUnauthorized is returned by Authenticators for requests without
+	// valid credentials.
+	ErrUnauthorized = errors.New("reverse http client is not authenticated")
+
+	// ErrForbidden is returned by Authenticators for clients that are not
+	// allowed to connect.
+	ErrForbidden = errors.New("reverse http client is not allowed to connect")
+)
+
+// Authenticate authenticates the upgrade request r with a. If it fails, the
+// request is answered with 401 Unauthorized for errors that match
+// ErrUnauthorized, or with 403 Forbidden for any other error, and the error is
+// returned.
+func Authenticate(w http.ResponseWriter, r *http.Request, a Authenticator) (Identity, error) {
+	identity, err := a.Authenticate(r)
+	if errors.Is(err, ErrUnauthorized) {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+	}
+	return identity, err
+}
+
+// BearerAuth returns an Authenticator that accepts requests with an
+// "Authorization: Bearer <token>" header, where tokens maps every accepted
+// token to the ID of its client.
+func BearerAuth(tokens map[string]string) Authenticator {
+	return AuthenticatorFunc(func(r *http.Request) (Identity, error) {
+		auth := r.Header.Get("Authorization")
+		if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+			return Identity{}, ErrUnauthorized
+		}
+		token := []byte(strings.TrimSpace(auth[7:]))
+
+		// compare against every token so timing reveals nothing
+		id, found := "", false
+		for t, tid := range tokens {
+			if subtle.ConstantTimeCompare([]byte(t), token) == 1 {
+				id, found = tid, true
+			}
+		}
+		if !found {
+			return Identity{}, ErrUnauthorized
+		}
+		return Identity{ID: id, Method: "bearer"}, nil
+	})
+}
+
+// BasicAuth returns an Authenticator that accepts requests with HTTP Basic
+// credentials for which check returns true. The client ID is the username.
+func BasicAuth(check func(username, password string) bool) Authenticator {
+	return AuthenticatorFunc(func(r *http.Request) (Identity, error) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || !check(user, pass) {
+			return Identity{}, ErrUnauthorized
+		}
+		return Identity{ID: user, Method: "basic"}, nil
+	})
+}
+
+// Headers set by SignHMAC and checked by HMACAuth.
+const (
+	TimestampHeader = "Ptth-Timestamp"
+	SignatureHeader = "Ptth-Signature"
+)
+
+// hmacSignature signs the method and request URI of an upgrade request along
+// with the client id and the timestamp.
+func hmacSignature(secret []byte, method, uri, id, timestamp string) string {
+	if method == "" {
+		method = "GET"
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(method + "\n" + uri + "\n" + id + "\n" + timestamp))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignHMAC signs the upgrade request r for the client id with secret, for
+// verification by HMACAuth. The signature covers the method and the request
+// URI of r, so it has to be signed after its URL is final. It sets
+// ClientIDHeader, TimestampHeader and SignatureHeader, so it has to be called
+// again for every request, for example from Dialer.Prepare.
+func SignHMAC(r *http.Request, id string, secret []byte) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	r.Header.Set(ClientIDHeader, id)
+	r.Header.Set(TimestampHeader, timestamp)
+	r.Header.Set(SignatureHeader,
+		hmacSignature(secret, r.Method, r.URL.RequestURI(), id, timestamp))
+}
+
+// HMACAuth returns an Authenticator that accepts requests signed by SignHMAC
+// with secret, no more than maxSkew before or after they are received.
+//
+// Signatures carry no nonce: anyone who captures a signed request can replay
+// it, to the same method and request URI, until maxSkew has passed, so
+// requests should only be signed over TLS, and maxSkew kept short. The host
+// is not signed, as proxies in front of the server may rewrite it, but a
+// proxy that rewrites the request URI makes every signature invalid.
+func HMACAuth(secret []byte, maxSkew time.Duration) Authenticator {
+	return AuthenticatorFunc(func(r *http.Request) (Identity, error) {
+		id := r.Header.Get(ClientIDHeader)
+		timestamp := r.Header.Get(TimestampHeader)
+		signature := r.Header.Get(SignatureHeader)
+		if id == "" || timestamp == "" || signature == "" {
+			return Identity{}, ErrUnauthorized
+		}
+
+		secs, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return Identity{}, ErrUnauthorized
+		}
+		skew := time.Since(time.Unix(secs, 0))
+		if skew > maxSkew || skew < -maxSkew {
+			return Identity{}, ErrUnauthorized
+		}
+
+		expected := hmacSignature(secret, r.Method, r.URL.RequestURI(), id, timestamp)
+		if !hmac.Equal([]byte(expected), []byte(strings.ToLower(signature))) {
+			return Identity{}, ErrUnauthorized
+		}
+		return Identity{ID: id, Method: "hmac"}, nil
+	})
+}
+
+// ClientCertAuth returns an Authenticator that accepts requests made over TLS
+// with a verified client certificate. The client ID is the common name of the
+// certificate's subject. The server's tls.Config has to request and verify
+// client certificates, for example with tls.RequireAndVerifyClientCert.
+func ClientCertAuth() Authenticator {
+	return AuthenticatorFunc(func(r *http.Request) (Identity, error) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 ||
+			len(r.TLS.VerifiedChains[0]) == 0 {
+			return Identity{}, ErrUnauthorized
+		}
+
+		cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		if cn == "" {
+			return Identity{}, ErrForbidden
+		}
+		return Identity{ID: cn, Method: "tls"}, nil
+	})
+}
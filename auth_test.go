@@ -0,0 +1,213 @@
+package reversehttp
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAuthenticate(t *testing.T) {
+	r := httptest.NewRequest("POST", "http://example.com/ptth", nil)
+
+	for _, c := range []struct {
+		err    error
+		status int
+	}{
+		{ErrUnauthorized, http.StatusUnauthorized},
+		{fmt.Errorf("token expired: %w", ErrUnauthorized), http.StatusUnauthorized},
+		{ErrForbidden, http.StatusForbidden},
+		{errors.New("banned"), http.StatusForbidden},
+	} {
+		w := httptest.NewRecorder()
+		_, err := Authenticate(w, r, AuthenticatorFunc(func(*http.Request) (Identity, error) {
+			return Identity{}, c.err
+		}))
+		expect(t, c.err, err)
+		expect(t, c.status, w.Code)
+	}
+
+	w := httptest.NewRecorder()
+	identity, err := Authenticate(w, r, AuthenticatorFunc(func(*http.Request) (Identity, error) {
+		return Identity{ID: "a", Method: "test"}, nil
+	}))
+	expect(t, nil, err)
+	expect(t, Identity{ID: "a", Method: "test"}, identity)
+	expect(t, false, w.Flushed)
+	expect(t, 0, w.Body.Len())
+}
+
+func TestBearerAuth(t *testing.T) {
+	auth := BearerAuth(map[string]string{"secret-a": "a", "secret-b": "b"})
+	r := httptest.NewRequest("POST", "http://example.com/ptth", nil)
+
+	_, err := auth.Authenticate(r)
+	expect(t, ErrUnauthorized, err)
+
+	r.Header.Set("Authorization", "Bearer secret-c")
+	_, err = auth.Authenticate(r)
+	expect(t, ErrUnauthorized, err)
+
+	r.Header.Set("Authorization", "bearer secret-b")
+	identity, err := auth.Authenticate(r)
+	expect(t, nil, err)
+	expect(t, Identity{ID: "b", Method: "bearer"}, identity)
+}
+
+func TestBasicAuth(t *testing.T) {
+	auth := BasicAuth(func(user, pass string) bool {
+		return user == "a" && pass == "pass"
+	})
+	r := httptest.NewRequest("POST", "http://example.com/ptth", nil)
+
+	_, err := auth.Authenticate(r)
+	expect(t, ErrUnauthorized, err)
+
+	r.SetBasicAuth("a", "wrong")
+	_, err = auth.Authenticate(r)
+	expect(t, ErrUnauthorized, err)
+
+	r.SetBasicAuth("a", "pass")
+	identity, err := auth.Authenticate(r)
+	expect(t, nil, err)
+	expect(t, Identity{ID: "a", Method: "basic"}, identity)
+}
+
+func TestHMACAuth(t *testing.T) {
+	secret := []byte("secret")
+	auth := HMACAuth(secret, time.Minute)
+	r := httptest.NewRequest("POST", "http://example.com/ptth", nil)
+
+	_, err := auth.Authenticate(r)
+	expect(t, ErrUnauthorized, err)
+
+	SignHMAC(r, "a", secret)
+	identity, err := auth.Authenticate(r)
+	expect(t, nil, err)
+	expect(t, Identity{ID: "a", Method: "hmac"}, identity)
+
+	// the signature covers the id
+	r.Header.Set(ClientIDHeader, "b")
+	_, err = auth.Authenticate(r)
+	expect(t, ErrUnauthorized, err)
+
+	// and the method and request URI
+	SignHMAC(r, "a", secret)
+	for _, target := range []string{"/other", "/ptth?x=1"} {
+		other := httptest.NewRequest("POST", "http://example.com"+target, nil)
+		other.Header = r.Header
+		_, err = auth.Authenticate(other)
+		expect(t, ErrUnauthorized, err)
+	}
+	other := httptest.NewRequest("PUT", "http://example.com/ptth", nil)
+	other.Header = r.Header
+	_, err = auth.Authenticate(other)
+	expect(t, ErrUnauthorized, err)
+
+	SignHMAC(r, "a", []byte("other secret"))
+	_, err = auth.Authenticate(r)
+	expect(t, ErrUnauthorized, err)
+
+	// old signatures are rejected
+	timestamp := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	r.Header.Set(ClientIDHeader, "a")
+	r.Header.Set(TimestampHeader, timestamp)
+	r.Header.Set(SignatureHeader, hmacSignature(secret, "POST", "/ptth", "a", timestamp))
+	_, err = auth.Authenticate(r)
+	expect(t, ErrUnauthorized, err)
+
+	r.Header.Set(TimestampHeader, "yesterday")
+	_, err = auth.Authenticate(r)
+	expect(t, ErrUnauthorized, err)
+}
+
+func TestClientCertAuth(t *testing.T) {
+	auth := ClientCertAuth()
+	r := httptest.NewRequest("POST", "https://example.com/ptth", nil)
+
+	r.TLS = nil
+	_, err := auth.Authenticate(r)
+	expect(t, ErrUnauthorized, err)
+
+	r.TLS = &tls.ConnectionState{}
+	_, err = auth.Authenticate(r)
+	expect(t, ErrUnauthorized, err)
+
+	cert := &x509.Certificate{}
+	r.TLS.VerifiedChains = [][]*x509.Certificate{{cert}}
+	_, err = auth.Authenticate(r)
+	expect(t, ErrForbidden, err)
+
+	cert.Subject = pkix.Name{CommonName: "a"}
+	identity, err := auth.Authenticate(r)
+	expect(t, nil, err)
+	expect(t, Identity{ID: "a", Method: "tls"}, identity)
+}
+
+func TestHubAuthenticator(t *testing.T) {
+	secret := []byte("secret")
+	hub := &Hub{Authenticator: HMACAuth(secret, time.Minute)}
+	connected := watchHub(hub)
+	srv := httptest.NewServer(hub)
+	defer srv.Close()
+	defer hub.Close()
+
+	d := &Dialer{Client: srv.Client()}
+	_, err := d.Upgrade(context.Background(), srv.URL)
+	if err == nil {
+		t.Error("unauthenticated upgrade succeeded")
+	}
+
+	d.Prepare = func(r *http.Request) error {
+		SignHMAC(r, "agent", secret)
+		return nil
+	}
+	resp, _ := connectHub(t, d, srv.URL, http.NotFoundHandler())
+	expect(t, "agent", resp.Header.Get(ClientIDHeader))
+	expect(t, "agent", <-connected)
+
+	identity, ok := hub.Identity("agent")
+	expect(t, true, ok)
+	expect(t, Identity{ID: "agent", Method: "hmac"}, identity)
+	expect(t, identity, hub.Conn("agent").Identity())
+
+	_, ok = hub.Identity("other")
+	expect(t, false, ok)
+}
+
+func TestUpgraderAuthenticator(t *testing.T) {
+	conns := make(chan *ReverseConn, 1)
+	u := &Upgrader{Authenticator: BearerAuth(map[string]string{"token": "agent"})}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := u.Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		conns <- c
+	}))
+	defer srv.Close()
+
+	d := &Dialer{Client: srv.Client()}
+	_, err := d.Upgrade(context.Background(), srv.URL)
+	var rejected *UpgradeRejectedError
+	if expect(t, true, errors.As(err, &rejected)) {
+		expect(t, http.StatusUnauthorized, rejected.StatusCode)
+	}
+
+	d.Header = http.Header{"Authorization": {"Bearer token"}}
+	resp, err := d.Upgrade(context.Background(), srv.URL)
+	if !expect(t, nil, err) {
+		return
+	}
+	defer resp.Body.Close()
+	c := <-conns
+	defer c.Close()
+	expect(t, Identity{ID: "agent", Method: "bearer"}, c.Identity())
+}
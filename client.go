@@ -3,43 +3,70 @@ package reversehttp
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
 	"sync"
 )
 
 // NewRequest creates an http.Request that will upgrade the connections to
-// Reverse HTTP.
+// Reverse HTTP. It offers every supported version of the protocol, PTTH/1.0
+// first, so that servers that only support it accept the request.
 func NewRequest(url string) (*http.Request, error) {
-	req, err := http.NewRequest("POST", url, nil)
+	return NewUpgradeRequest("POST", url, nil)
+}
+
+// NewUpgradeRequest is like NewRequest, but the upgrade request is made with
+// the given method and body. Some peers expect GET, and some proxies
+// mishandle POST requests without a body. The server discards whatever of the
+// body its handler has not read before it upgrades the connection.
+func NewUpgradeRequest(method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
 	if err != nil {
 		return req, err
 	}
-	req.Header.Add("Upgrade", "PTTH/1.0")
+	for _, p := range offers {
+		req.Header.Add("Upgrade", p)
+	}
 	req.Header.Add("Connection", "Upgrade")
 	return req, nil
 }
 
 // IsReverseHTTPResponse returns true if response is a valid Reverse HTTP
 // upgrade Response (i.e. a valid HTTP/1.1 protocol upgrade response where the
-// Upgrade Header is "PTTH/1.0).  This function will return False otherwise,
-// including when resp is nil.
+// Upgrade Header lists a supported version of the protocol, such as
+// "PTTH/1.0"), or a 200 OK HTTP/2 response whose HTTP2UpgradeHeader does.
+// Tokens are matched as IsReverseHTTPRequest does. This function will return
+// False otherwise, including when resp is nil.
 func IsReverseHTTPResponse(resp *http.Response) bool {
 	if resp == nil {
 		return false
 	}
 
-	return resp.Header.Get("Upgrade") == "PTTH/1.0" &&
-		resp.Header.Get("Connection") == "Upgrade" &&
+	if resp.ProtoMajor == 2 {
+		return negotiate(resp.Header, HTTP2UpgradeHeader, protocols) != "" &&
+			resp.StatusCode == http.StatusOK
+	}
+	return negotiate(resp.Header, "Upgrade", protocols) != "" &&
+		headerHasToken(resp.Header, "Connection", "Upgrade") &&
 		resp.StatusCode == http.StatusSwitchingProtocols
 }
 
+// maxBufferedBody is how much of a body is buffered in an attempt to send it
+// with a Content-Length. Longer bodies, and bodies that are flushed, are
+// streamed with chunked transfer encoding.
+const maxBufferedBody = 4 << 10
+
 type response struct {
 	mu          sync.Mutex
+	conn        net.Conn
 	rw          *bufio.ReadWriter
 	bodybuf     *bytes.Buffer
 	req         *http.Request
@@ -48,10 +75,19 @@ type response struct {
 	headwritten bool
 	flushed     bool
 	hijacked    bool
+	closing     bool
+
+	// once flushed, the body is written to body, which encodes it as
+	// required by the headers
+	body     io.Writer
+	chunked  io.WriteCloser
+	written  int64
+	declared int64
 }
 
-func newResponse(req *http.Request, rw *bufio.ReadWriter) *response {
+func newResponse(req *http.Request, conn net.Conn, rw *bufio.ReadWriter) *response {
 	return &response{
+		conn:        conn,
 		rw:          rw,
 		bodybuf:     new(bytes.Buffer),
 		req:         req,
@@ -59,6 +95,8 @@ func newResponse(req *http.Request, rw *bufio.ReadWriter) *response {
 		headwritten: false,
 		flushed:     false,
 		hijacked:    false,
+		closing:     false,
+		declared:    -1,
 	}
 }
 
@@ -78,7 +116,13 @@ func (r *response) Write(b []byte) (int, error) {
 		r.writeHeaderLocked(http.StatusOK)
 	}
 
-	return r.bodybuf.Write(b)
+	if !r.flushed {
+		if r.bodybuf.Len()+len(b) <= maxBufferedBody {
+			return r.bodybuf.Write(b)
+		}
+		r.startBodyLocked()
+	}
+	return r.writeBodyLocked(b)
 }
 
 func (r *response) writeHeaderLocked(statusCode int) {
@@ -98,26 +142,94 @@ func (r *response) WriteHeader(statusCode int) {
 	r.writeHeaderLocked(statusCode)
 }
 
-func (r *response) flushLocked() {
+// writeBodyLocked writes b to the body of a flushed response.
+func (r *response) writeBodyLocked(b []byte) (int, error) {
+	if r.declared >= 0 && r.written+int64(len(b)) > r.declared {
+		return 0, http.ErrContentLength
+	}
+
+	n, err := r.body.Write(b)
+	r.written += int64(n)
+	return n, err
+}
+
+// startBodyLocked writes the headers of a response whose body is not entirely
+// known yet. The body is delimited by the Content-Length set by the handler,
+// by chunked transfer encoding, or, for HTTP/1.0, by closing the connection.
+func (r *response) startBodyLocked() {
+	r.writeHeaderLocked(http.StatusOK)
+
+	switch {
+	case !r.bodyAllowedLocked():
+		r.body = ioutil.Discard
+	case r.header.Get("Content-Length") != "":
+		n, err := strconv.ParseInt(r.header.Get("Content-Length"), 10, 64)
+		if err == nil && n >= 0 {
+			r.declared = n
+		} else {
+			r.header.Del("Content-Length")
+			r.closing = true
+		}
+		r.body = r.rw
+	case r.req.ProtoAtLeast(1, 1):
+		r.header.Set("Transfer-Encoding", "chunked")
+		r.chunked = httputil.NewChunkedWriter(r.rw)
+		r.body = r.chunked
+	default:
+		r.closing = true
+		r.body = r.rw
+	}
 
+	r.writeHeadLocked()
+	r.flushed = true
+
+	buffered := r.bodybuf.Bytes()
+	r.bodybuf = new(bytes.Buffer)
+	r.writeBodyLocked(buffered)
+}
+
+func (r *response) flushLocked() {
 	if r.hijacked {
 		return
 	}
 
 	if !r.flushed {
-		resp := http.Response{
-			StatusCode: r.status,
-			ProtoMajor: r.req.ProtoMajor,
-			ProtoMinor: r.req.ProtoMinor,
-			Request:    r.req,
-			Header:     r.header,
+		r.startBodyLocked()
+	}
+	r.rw.Flush()
+}
+
+// closingLocked reports whether the connection should be closed once this
+// response has been written.
+func (r *response) closingLocked() bool {
+	return r.closing || r.req.Close ||
+		hasToken(r.header.Get("Connection"), "close")
+}
+
+// bodyAllowedLocked reports whether a body may follow the headers.
+func (r *response) bodyAllowedLocked() bool {
+	return r.req.Method != "HEAD" && r.status >= 200 &&
+		r.status != http.StatusNoContent && r.status != http.StatusNotModified
+}
+
+// writeHeadLocked writes the status line and headers.
+func (r *response) writeHeadLocked() {
+	if r.closingLocked() {
+		if !hasToken(r.header.Get("Connection"), "close") {
+			r.header.Add("Connection", "close")
 		}
-		resp.Write(r.rw)
+	} else if !r.req.ProtoAtLeast(1, 1) {
+		r.header.Set("Connection", "keep-alive")
 	}
 
-	r.rw.ReadFrom(r.bodybuf)
-	r.rw.Flush()
-	r.flushed = true
+	text := http.StatusText(r.status)
+	if text == "" {
+		text = "status code " + strconv.Itoa(r.status)
+	}
+	fmt.Fprintf(r.rw, "HTTP/%d.%d %03d %s\r\n",
+		r.req.ProtoMajor, r.req.ProtoMinor, r.status, text)
+	r.header.Write(r.rw)
+	r.rw.WriteString("\r\n")
 }
 
 func (r *response) Flush() {
@@ -131,22 +243,38 @@ func (r *response) Close() {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	if r.hijacked {
+		return
+	}
+
+	r.writeHeaderLocked(http.StatusOK)
 	if !r.flushed {
-		resp := http.Response{
-			StatusCode:    r.status,
-			ProtoMajor:    r.req.ProtoMajor,
-			ProtoMinor:    r.req.ProtoMinor,
-			Request:       r.req,
-			Header:        r.header,
-			ContentLength: int64(r.bodybuf.Len()),
-			Body:          ioutil.NopCloser(r.bodybuf),
+		// the whole body is known, send it with its length
+		if r.bodyAllowedLocked() {
+			r.header.Del("Transfer-Encoding")
+			r.header.Set("Content-Length", strconv.Itoa(r.bodybuf.Len()))
 		}
-		resp.Write(r.rw)
-		r.rw.Flush()
-	} else {
-		r.rw.ReadFrom(r.bodybuf)
-		r.rw.Flush()
+		r.writeHeadLocked()
+		if r.bodyAllowedLocked() {
+			r.rw.ReadFrom(r.bodybuf)
+		}
+	} else if r.chunked != nil {
+		r.chunked.Close()
+		r.rw.WriteString("\r\n")
+	} else if r.declared >= 0 && r.written != r.declared {
+		// the peer is still waiting for the rest of the body
+		r.closing = true
 	}
+	r.rw.Flush()
+}
+
+// keepAlive reports whether another request can be read from the connection
+// after this response has been closed.
+func (r *response) keepAlive() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return !r.hijacked && !r.closingLocked()
 }
 
 func (r *response) Hijack() (net.Conn, *bufio.ReadWriter, error) {
@@ -157,54 +285,151 @@ func (r *response) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 		return nil, nil, errors.New("cannot re-hijack response")
 	}
 
-	r.writeHeaderLocked(http.StatusOK)
-	r.flushLocked()
+	// like net/http, only what the handler has already written is sent, the
+	// rest of the response is up to the handler
+	if r.headwritten && !r.flushed {
+		r.writeHeadLocked()
+		r.rw.ReadFrom(r.bodybuf)
+	}
+	r.rw.Flush()
 
 	r.hijacked = true
-	return nil, r.rw, nil
+	return r.conn, r.rw, nil
 }
 
-// ReverseResponse serves the http request in the upgraded body of response
-// with the provided handler.
+// ReverseResponse serves the http requests in the upgraded body of response
+// with the provided handler. Requests are read from the connection until the
+// server closes it, a request or response asks for the connection to be
+// closed, or an error occurs.
 func ReverseResponse(resp *http.Response, handler http.Handler) error {
-	if !IsReverseHTTPResponse(resp) {
-		return errors.New(
-			"response is not a valid reverse http upgrade response")
+	return ReverseResponseContext(context.Background(), resp, handler)
+}
+
+// ReverseResponseContext is like ReverseResponse, but when ctx is done the
+// connection is closed, interrupting the wait for the next request, and
+// ctx.Err() is returned. The context of each request passed to handler is
+// derived from ctx, and is cancelled when handler returns.
+//
+// If handler hijacks the connection, it is left open for handler and nil is
+// returned.
+func ReverseResponseContext(ctx context.Context, resp *http.Response, handler http.Handler) error {
+	if resp == nil {
+		return ErrUpgradeRejected
+	} else if !IsReverseHTTPResponse(resp) {
+		return newUpgradeRejectedError(resp)
 	}
 
-	breader := resp.Body
-	bwriter := resp.Body.(io.Writer)
+	// closing the body interrupts whatever is reading from it
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			resp.Body.Close()
+		case <-stop:
+		}
+	}()
 
-	rw := bufio.NewReadWriter(bufio.NewReader(breader),
-		bufio.NewWriter(bwriter))
+	conn := newBodyConn(resp.Body.(io.ReadWriteCloser))
 
-	// TODO: http persistent connections
+	var err error
+	if headerHasToken(resp.Header, upgradeHeader(resp.ProtoMajor), MuxProtocol) {
+		sess := newSession(bufio.NewReader(conn), bufio.NewWriter(conn),
+			conn, conn, false)
+		err = serveMux(ctx, sess, handler)
+	} else {
+		rw := bufio.NewReadWriter(bufio.NewReader(conn),
+			bufio.NewWriter(conn))
+		err = serveConn(ctx, conn, rw, handler)
+	}
+	close(stop)
 
-	req, err := http.ReadRequest(rw.Reader)
-	if err != nil {
-		return fmt.Errorf("error reading request: %v", err)
+	if err == errHijacked {
+		// the connection belongs to the handler now
+		return nil
 	}
-	w := newResponse(req, rw)
-	handler.ServeHTTP(w, req)
-	w.Close()
 	resp.Body.Close()
-	return nil
+	return err
+}
+
+// errHijacked is returned by serveConn when a handler has hijacked the
+// connection, which must then be left open.
+var errHijacked = errors.New("connection has been hijacked")
+
+// serveConn serves the requests read from rw with handler, until the
+// connection is closed or a request or response asks for it to be.
+func serveConn(ctx context.Context, conn net.Conn, rw *bufio.ReadWriter, handler http.Handler) error {
+	for served := 0; ; served++ {
+		req, err := http.ReadRequest(rw.Reader)
+		if err != nil && ctx.Err() != nil {
+			return ctx.Err()
+		} else if err == io.EOF && served > 0 {
+			// the server has finished with the connection
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("error reading request: %w", err)
+		}
+
+		reqctx, reqcancel := context.WithCancel(ctx)
+		req = req.WithContext(reqctx)
+
+		w := newResponse(req, conn, rw)
+		// like net/http, OPTIONS * is answered without the handler
+		if !isHeartbeatRequest(req) {
+			handler.ServeHTTP(w, req)
+		}
+		w.Close()
+		reqcancel()
+		if w.hijacked {
+			return errHijacked
+		} else if !w.keepAlive() {
+			return nil
+		}
+
+		// discard what the handler left unread so the next request can be
+		// parsed
+		_, err = io.Copy(ioutil.Discard, req.Body)
+		req.Body.Close()
+		if err != nil && ctx.Err() != nil {
+			return ctx.Err()
+		} else if err != nil {
+			return fmt.Errorf("error reading request: %w", err)
+		}
+	}
+}
+
+// hasToken reports whether the comma-separated header value v contains token,
+// ignoring case.
+func hasToken(v, token string) bool {
+	for _, t := range strings.Split(v, ",") {
+		if strings.EqualFold(strings.TrimSpace(t), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// headerHasToken reports whether any of the values of the header name in h
+// contains token.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		if hasToken(v, token) {
+			return true
+		}
+	}
+	return false
 }
 
 // Reverse makes a Reverse HTTP request to url, executes it using
 // http.DefaultClient, and then calls ReverseResponse on the response and
 // provided handler.
 func Reverse(url string, handler http.Handler) error {
-	req, err := NewRequest(url)
-	if err != nil {
-		return err
-	}
+	return ReverseContext(context.Background(), url, handler)
+}
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return err
-	}
-	return ReverseResponse(resp, handler)
+// ReverseContext is like Reverse, but the upgrade request is made with ctx,
+// and the response is served with ReverseResponseContext.
+func ReverseContext(ctx context.Context, url string, handler http.Handler) error {
+	return new(Dialer).Reverse(ctx, url, handler)
 }
 
 // ReverseFunc is Exactly the Same as Reverse but takes a function compatible
@@ -212,3 +437,9 @@ func Reverse(url string, handler http.Handler) error {
 func ReverseFunc(url string, fun func(w http.ResponseWriter, r *http.Request)) error {
 	return Reverse(url, http.HandlerFunc(fun))
 }
+
+// ReverseFuncContext is like ReverseContext but takes a function compatible
+// with http.HandlerFunc instead of an http.Handler
+func ReverseFuncContext(ctx context.Context, url string, fun func(w http.ResponseWriter, r *http.Request)) error {
+	return ReverseContext(ctx, url, http.HandlerFunc(fun))
+}
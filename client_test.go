@@ -3,13 +3,16 @@ package reversehttp
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func expect(t *testing.T, expected interface{}, got interface{}) bool {
@@ -57,6 +60,15 @@ func TestIsReverseHTTPResponse(t *testing.T) {
 		Header:     h,
 	}))
 
+	h = http.Header{}
+	h.Add("Upgrade", "PTTH/1.0, websocket")
+	h.Add("Connection", "close")
+	h.Add("Connection", "UPGRADE")
+	expect(t, true, IsReverseHTTPResponse(&http.Response{
+		StatusCode: 101,
+		Header:     h,
+	}))
+
 	expect(t, false, IsReverseHTTPResponse(nil))
 }
 
@@ -67,7 +79,7 @@ func TestInternalResponse(t *testing.T) {
 	buf := bytes.NewBuffer(make([]byte, 0))
 	rw := bufio.NewReadWriter(nil, bufio.NewWriter(buf))
 
-	resp := newResponse(req, rw)
+	resp := newResponse(req, nil, rw)
 	resp.Header().Add("Content-Type", "application/x-testtype")
 
 	resp.Write([]byte("hello world\n"))
@@ -82,7 +94,7 @@ func TestInternalResponse(t *testing.T) {
 	buf = bytes.NewBuffer(make([]byte, 0))
 	rw = bufio.NewReadWriter(nil, bufio.NewWriter(buf))
 
-	resp = newResponse(req, rw)
+	resp = newResponse(req, nil, rw)
 	resp.Header().Add("Content-Type", "application/x-testtype")
 
 	resp.WriteHeader(http.StatusOK)
@@ -100,11 +112,11 @@ func TestInternalResponseFlush(t *testing.T) {
 	req, err := NewRequest("http://example.com/path")
 	expect(t, nil, err)
 
-	expected := []byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\nContent-Type: application/x-testtype\r\n\r\nhello world\n")
+	expected := []byte("HTTP/1.1 200 OK\r\nContent-Type: application/x-testtype\r\nTransfer-Encoding: chunked\r\n\r\n6\r\nhello \r\n6\r\nworld\n\r\n0\r\n\r\n")
 	buf := bytes.NewBuffer(make([]byte, 0))
 	rw := bufio.NewReadWriter(nil, bufio.NewWriter(buf))
 
-	resp := newResponse(req, rw)
+	resp := newResponse(req, nil, rw)
 	resp.Header().Add("Content-Type", "application/x-testtype")
 
 	resp.Write([]byte("hello "))
@@ -117,19 +129,71 @@ func TestInternalResponseFlush(t *testing.T) {
 	expect(t, string(expected), string(b))
 }
 
+func TestInternalResponseStream(t *testing.T) {
+	req, err := NewRequest("http://example.com/path")
+	expect(t, nil, err)
+
+	buf := bytes.NewBuffer(make([]byte, 0))
+	rw := bufio.NewReadWriter(nil, bufio.NewWriter(buf))
+
+	// bodies too large to buffer are sent as they are written
+	body := bytes.Repeat([]byte("hello world\n"), 1000)
+	resp := newResponse(req, nil, rw)
+	resp.Write(body)
+	expect(t, true, buf.Len() > 0)
+	expect(t, true, resp.bodybuf.Len() <= maxBufferedBody)
+	resp.Close()
+	expect(t, true, resp.keepAlive())
+
+	got, err := http.ReadResponse(bufio.NewReader(buf), req)
+	expect(t, nil, err)
+	expect(t, []string{"chunked"}, got.TransferEncoding)
+	b, err := ioutil.ReadAll(got.Body)
+	expect(t, nil, err)
+	expect(t, true, bytes.Equal(body, b))
+
+	// a Content-Length set by the handler is used instead of chunking
+	buf.Reset()
+	resp = newResponse(req, nil, rw)
+	resp.Header().Set("Content-Length", "11")
+	resp.Write([]byte("hello "))
+	resp.Flush()
+	_, err = resp.Write([]byte("world\n"))
+	expect(t, http.ErrContentLength, err)
+	resp.Write([]byte("world"))
+	resp.Close()
+	expect(t, true, resp.keepAlive())
+	expect(t, "HTTP/1.1 200 OK\r\nContent-Length: 11\r\n\r\nhello world", buf.String())
+
+	// HTTP/1.0 bodies are delimited by closing the connection
+	buf.Reset()
+	req.ProtoMinor = 0
+	resp = newResponse(req, nil, rw)
+	resp.Write([]byte("hello "))
+	resp.Flush()
+	resp.Write([]byte("world\n"))
+	resp.Close()
+	expect(t, false, resp.keepAlive())
+	expect(t, "HTTP/1.0 200 OK\r\nConnection: close\r\n\r\nhello world\n", buf.String())
+}
+
 func TestInternalResponseHijack(t *testing.T) {
 	req, err := NewRequest("http://example.com/path")
 	expect(t, nil, err)
 
-	expected := []byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\nContent-Type: application/x-testtype\r\n\r\nhullo werld\n")
+	expected := []byte("HTTP/1.1 200 OK\r\nContent-Type: application/x-testtype\r\n\r\nhullo werld\n")
 	buf := bytes.NewBuffer(make([]byte, 0))
 	rw := bufio.NewReadWriter(nil, bufio.NewWriter(buf))
 
-	resp := newResponse(req, rw)
+	body := &testBody{new(bytes.Buffer), new(bytes.Buffer)}
+	conn := newBodyConn(body)
+	resp := newResponse(req, conn, rw)
 	resp.Header().Add("Content-Type", "application/x-testtype")
+	resp.WriteHeader(http.StatusOK)
 
-	_, hbuf, err := resp.Hijack()
+	hconn, hbuf, err := resp.Hijack()
 	expect(t, nil, err)
+	expect(t, net.Conn(conn), hconn)
 
 	_, err = resp.Write([]byte("hello World"))
 	if err == nil {
@@ -152,6 +216,22 @@ func TestInternalResponseHijack(t *testing.T) {
 	b, err := ioutil.ReadAll(buf)
 	expect(t, nil, err)
 	expect(t, string(expected), string(b))
+
+	// nothing is written for handlers that write their own response
+	buf.Reset()
+	resp = newResponse(req, conn, rw)
+	resp.Header().Add("Content-Type", "application/x-testtype")
+	_, hbuf, err = resp.Hijack()
+	expect(t, nil, err)
+	hbuf.WriteString("HTTP/1.1 101 Switching Protocols\r\n\r\n")
+	hbuf.Flush()
+	resp.Close()
+	expect(t, false, resp.keepAlive())
+	expect(t, "HTTP/1.1 101 Switching Protocols\r\n\r\n", buf.String())
+
+	// without the underlying connection, deadlines can't be set
+	expect(t, errNoDeadline, hconn.SetDeadline(time.Now()))
+	expect(t, nil, hconn.Close())
 }
 
 type testBody struct {
@@ -226,6 +306,166 @@ func TestReverseResponse(t *testing.T) {
 	}
 }
 
+func TestReverseResponseHeartbeat(t *testing.T) {
+	h := http.Header{}
+	h.Add("Upgrade", "PTTH/1.0")
+	h.Add("Connection", "Upgrade")
+
+	wbuf := new(bytes.Buffer)
+	rbuf := new(bytes.Buffer)
+	req := newHeartbeatRequest(context.Background())
+	req.Close = true
+	req.Write(rbuf)
+
+	err := ReverseResponse(&http.Response{
+		StatusCode: http.StatusSwitchingProtocols,
+		Header:     h,
+		Body:       &testBody{wbuf, rbuf},
+	}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("handler called for a heartbeat")
+	}))
+	expect(t, nil, err)
+	expect(t, "HTTP/1.1 200 OK\r\nConnection: close\r\nContent-Length: 0\r\n\r\n", wbuf.String())
+}
+
+func TestReverseResponseKeepAlive(t *testing.T) {
+	var handler http.HandlerFunc
+	handler = func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}
+
+	h := http.Header{}
+	h.Add("upgrade", "PTTH/1.0")
+	h.Add("CONNECTION", "Upgrade")
+
+	// the handler ignores the request bodies, they must still be skipped
+	rbuf := new(bytes.Buffer)
+	for _, path := range []string{"/a", "/b", "/c"} {
+		req, err := http.NewRequest("POST", "http://example.com"+path,
+			bytes.NewReader([]byte("ignored")))
+		expect(t, nil, err)
+		req.Write(rbuf)
+	}
+
+	wbuf := new(bytes.Buffer)
+	err := ReverseResponse(&http.Response{
+		StatusCode: http.StatusSwitchingProtocols,
+		Header:     h,
+		Body:       &testBody{wbuf, rbuf},
+	}, handler)
+	expect(t, nil, err)
+
+	br := bufio.NewReader(wbuf)
+	for _, path := range []string{"/a", "/b", "/c"} {
+		resp, err := http.ReadResponse(br, nil)
+		if !expect(t, nil, err) {
+			return
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		expect(t, nil, err)
+		expect(t, path, string(b))
+		expect(t, false, resp.Close)
+	}
+
+	// Connection: close and HTTP/1.0 both end the session after one request
+	for _, raw := range []string{
+		"GET /a HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n",
+		"GET /a HTTP/1.0\r\nHost: example.com\r\n\r\n",
+	} {
+		rbuf = bytes.NewBufferString(raw + raw)
+		wbuf = new(bytes.Buffer)
+		err = ReverseResponse(&http.Response{
+			StatusCode: http.StatusSwitchingProtocols,
+			Header:     h,
+			Body:       &testBody{wbuf, rbuf},
+		}, handler)
+		expect(t, nil, err)
+
+		br := bufio.NewReader(wbuf)
+		resp, err := http.ReadResponse(br, nil)
+		expect(t, nil, err)
+		expect(t, true, resp.Close)
+		ioutil.ReadAll(resp.Body)
+		_, err = br.Peek(1)
+		expect(t, io.EOF, err)
+	}
+
+	// HTTP/1.0 keep-alive is honoured
+	raw := "GET /a HTTP/1.0\r\nHost: example.com\r\nConnection: keep-alive\r\n\r\n"
+	rbuf = bytes.NewBufferString(raw + raw)
+	wbuf = new(bytes.Buffer)
+	err = ReverseResponse(&http.Response{
+		StatusCode: http.StatusSwitchingProtocols,
+		Header:     h,
+		Body:       &testBody{wbuf, rbuf},
+	}, handler)
+	expect(t, nil, err)
+
+	br = bufio.NewReader(wbuf)
+	for i := 0; i < 2; i++ {
+		resp, err := http.ReadResponse(br, nil)
+		expect(t, nil, err)
+		expect(t, "keep-alive", resp.Header.Get("Connection"))
+		ioutil.ReadAll(resp.Body)
+	}
+}
+
+// pipeBody is an upgraded body whose requests are written by a test.
+type pipeBody struct {
+	*io.PipeReader
+	w io.Writer
+}
+
+func (pb *pipeBody) Write(p []byte) (int, error) {
+	return pb.w.Write(p)
+}
+
+func TestReverseResponseContext(t *testing.T) {
+	h := http.Header{}
+	h.Add("upgrade", "PTTH/1.0")
+	h.Add("CONNECTION", "Upgrade")
+
+	pr, pw := io.Pipe()
+	resp := &http.Response{
+		StatusCode: http.StatusSwitchingProtocols,
+		Header:     h,
+		Body:       &pipeBody{pr, new(bytes.Buffer)},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	reqctx := make(chan context.Context, 1)
+	result := make(chan error)
+	go func() {
+		result <- ReverseResponseContext(ctx, resp, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			reqctx <- r.Context()
+		}))
+	}()
+
+	pw.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	rctx := <-reqctx
+
+	// the agent is now blocked waiting for the next request
+	cancel()
+	expect(t, context.Canceled, <-result)
+	<-rctx.Done()
+
+	// the body was closed to interrupt the read
+	_, err := pw.Write([]byte("GET / HTTP/1.1\r\n"))
+	expect(t, io.ErrClosedPipe, err)
+}
+
+func TestReverseContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := ReverseFuncContext(ctx, "http://example.com/path", func(w http.ResponseWriter, r *http.Request) {
+		t.Error("handler called")
+	})
+	if err == nil {
+		t.Error("cancelled upgrade did not fail")
+	}
+}
+
 func TestReverse(t *testing.T) {
 	// simple echo handler
 	var handler http.HandlerFunc
@@ -242,7 +482,7 @@ func TestReverse(t *testing.T) {
 	}
 
 	http.DefaultClient = &http.Client{
-		Transport: newIoTripper(
+		Transport: newIoTripper(nil,
 			bufio.NewReadWriter(bufio.NewReader(errorWriter{true, true}),
 				bufio.NewWriter(errorWriter{true, true}))),
 	}
@@ -257,6 +497,7 @@ func TestReverse(t *testing.T) {
 	req, err := http.NewRequest("POST", "http://example.com/path",
 		ioutil.NopCloser(bytes.NewReader([]byte("hello world\n"))))
 	req.Header = rh
+	req.Close = true
 	expect(t, nil, err)
 
 	endserver := make(chan struct{})
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/petelliott/reversehttp"
+)
+
+// config is the configuration of the agent, read from a JSON file and
+// overridden by flags.
+type config struct {
+	// URL is the address of the gateway's upgrade endpoint.
+	URL string `json:"url"`
+
+	// Token is sent as a bearer token with every upgrade request.
+	Token string `json:"token"`
+
+	MinBackoff duration `json:"min_backoff"`
+	MaxBackoff duration `json:"max_backoff"`
+
+	TLS tlsConfig `json:"tls"`
+
+	// LogLevel is one of debug, info and error.
+	LogLevel string `json:"log_level"`
+
+	Tunnels []tunnel `json:"tunnels"`
+}
+
+type tlsConfig struct {
+	// CA is a PEM file of the certificates the gateway is verified with,
+	// instead of the system's.
+	CA string `json:"ca"`
+
+	// Cert and Key are PEM files of a client certificate.
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+
+	Insecure bool `json:"insecure"`
+}
+
+// tunnel exposes a target through its own reverse connection, registered
+// under ID.
+type tunnel struct {
+	ID     string `json:"id"`
+	Target string `json:"target"`
+}
+
+// duration is a time.Duration that is written as a string in JSON.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func loadConfig(path string) (*config, error) {
+	c := new(config)
+	if path == "" {
+		return c, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return c, nil
+}
+
+// parseTunnel parses a tunnel flag of the form id=target.
+func parseTunnel(s string) (tunnel, error) {
+	i := strings.Index(s, "=")
+	if i <= 0 || i == len(s)-1 {
+		return tunnel{}, fmt.Errorf("tunnel %q is not of the form id=target", s)
+	}
+	return tunnel{ID: s[:i], Target: s[i+1:]}, nil
+}
+
+// handler returns the handler serving target, which is one of:
+//
+//	8080, :8080, host:8080   a local port
+//	http://host:8080/path    an http or https service
+//	unix:/path/to/socket     an http service on a unix socket
+//	dir:/path/to/directory   a static directory
+func handler(target string) (http.Handler, error) {
+	switch {
+	case strings.HasPrefix(target, "dir:"):
+		dir := strings.TrimPrefix(target, "dir:")
+		if fi, err := os.Stat(dir); err != nil {
+			return nil, err
+		} else if !fi.IsDir() {
+			return nil, fmt.Errorf("%s is not a directory", dir)
+		}
+		return http.FileServer(http.Dir(dir)), nil
+	case strings.HasPrefix(target, "unix:"),
+		strings.HasPrefix(target, "http://"),
+		strings.HasPrefix(target, "https://"):
+		return reversehttp.NewProxy(target)
+	}
+
+	if _, err := strconv.Atoi(target); err == nil {
+		target = ":" + target
+	}
+	if strings.HasPrefix(target, ":") {
+		target = "localhost" + target
+	}
+	if !strings.Contains(target, ":") || strings.Contains(target, "://") {
+		return nil, fmt.Errorf("unknown target %q", target)
+	}
+	return reversehttp.NewProxy("http://" + target)
+}
+
+// tlsClientConfig returns the TLS configuration of the upgrade requests, or
+// nil if the defaults are fine.
+func (c *tlsConfig) tlsClientConfig() (*tls.Config, error) {
+	if c.CA == "" && c.Cert == "" && c.Key == "" && !c.Insecure {
+		return nil, nil
+	}
+
+	conf := &tls.Config{InsecureSkipVerify: c.Insecure}
+	if c.CA != "" {
+		pem, err := ioutil.ReadFile(c.CA)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", c.CA)
+		}
+	}
+	if c.Cert != "" || c.Key != "" {
+		if c.Cert == "" || c.Key == "" {
+			return nil, errors.New("a client certificate needs both a cert and a key")
+		}
+		cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf, nil
+}
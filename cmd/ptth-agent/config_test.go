@@ -0,0 +1,115 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/petelliott/reversehttp"
+)
+
+func TestParseTunnel(t *testing.T) {
+	tun, err := parseTunnel("web=localhost:8080")
+	if err != nil || tun != (tunnel{"web", "localhost:8080"}) {
+		t.Errorf("got %v, %v", tun, err)
+	}
+
+	for _, s := range []string{"web", "=8080", "web="} {
+		if _, err := parseTunnel(s); err == nil {
+			t.Errorf("parsed %q", s)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ptth-agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for target, upstream := range map[string]string{
+		"8080":                  "localhost:8080",
+		":8080":                 "localhost:8080",
+		"example.com:8080":      "example.com:8080",
+		"https://example.com/a": "example.com",
+		"unix:/run/app.sock":    "localhost",
+	} {
+		h, err := handler(target)
+		if err != nil {
+			t.Errorf("%s: %v", target, err)
+			continue
+		}
+		p, ok := h.(*reversehttp.Proxy)
+		if !ok || p.Upstream.Host != upstream {
+			t.Errorf("%s: got %#v", target, h)
+		}
+	}
+
+	if _, err := handler("dir:" + dir); err != nil {
+		t.Error(err)
+	}
+	for _, target := range []string{"dir:" + filepath.Join(dir, "missing"), "localhost", "ftp://example.com"} {
+		if _, err := handler(target); err == nil {
+			t.Errorf("accepted target %q", target)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ptth-agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "agent.json")
+	ioutil.WriteFile(path, []byte(`{
+		"url": "https://gateway.example.com/ptth",
+		"token": "secret",
+		"min_backoff": "2s",
+		"log_level": "debug",
+		"tunnels": [{"id": "web", "target": "8080"}]
+	}`), 0600)
+
+	c, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &config{
+		URL:        "https://gateway.example.com/ptth",
+		Token:      "secret",
+		MinBackoff: duration(2 * time.Second),
+		LogLevel:   "debug",
+		Tunnels:    []tunnel{{"web", "8080"}},
+	}
+	if !reflect.DeepEqual(expected, c) {
+		t.Errorf("expected: %v, got: %v", expected, c)
+	}
+
+	l, err := newLogger(c.LogLevel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agents, err := newAgents(c, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(agents) != 1 || agents[0].Dialer.Header.Get("Authorization") != "Bearer secret" ||
+		agents[0].Dialer.Header.Get(reversehttp.ClientIDHeader) != "web" {
+		t.Errorf("got agents %v", agents)
+	}
+
+	c.Tunnels = append(c.Tunnels, tunnel{"web", "8081"})
+	if _, err := newAgents(c, l); err == nil {
+		t.Error("accepted a duplicate tunnel")
+	}
+
+	ioutil.WriteFile(path, []byte(`{"unknown": true}`), 0600)
+	if _, err := loadConfig(path); err == nil {
+		t.Error("accepted an unknown setting")
+	}
+}
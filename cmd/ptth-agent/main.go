@@ -0,0 +1,226 @@
+// Command ptth-agent exposes local services through Reverse HTTP connections
+// to a gateway, such as ptth-gateway, so that they can be reached from
+// behind a NAT or firewall.
+//
+// Every tunnel is a connection of its own, registered under its ID, which is
+// reconnected whenever it fails:
+//
+//	ptth-agent -url https://gateway.example.com/ptth -token secret \
+//		-tunnel web=8080 -tunnel docs=dir:/srv/docs
+//
+// The same settings can be read from a JSON configuration file with -config,
+// flags override it.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/petelliott/reversehttp"
+)
+
+// tunnelFlags collects the -tunnel flags.
+type tunnelFlags []tunnel
+
+func (f *tunnelFlags) String() string {
+	s := make([]string, len(*f))
+	for i, t := range *f {
+		s[i] = t.ID + "=" + t.Target
+	}
+	return strings.Join(s, ",")
+}
+
+func (f *tunnelFlags) Set(v string) error {
+	t, err := parseTunnel(v)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, t)
+	return nil
+}
+
+// logger logs the messages of at least its level.
+type logger struct {
+	*log.Logger
+	level int
+}
+
+const (
+	levelDebug = iota
+	levelInfo
+	levelError
+)
+
+func newLogger(level string) (*logger, error) {
+	l := &logger{Logger: log.New(os.Stderr, "", log.LstdFlags)}
+	switch level {
+	case "debug":
+		l.level = levelDebug
+	case "info", "":
+		l.level = levelInfo
+	case "error":
+		l.level = levelError
+	default:
+		return nil, fmt.Errorf("unknown log level %q", level)
+	}
+	return l, nil
+}
+
+func (l *logger) logf(level int, format string, v ...interface{}) {
+	if level >= l.level {
+		l.Printf(format, v...)
+	}
+}
+
+func main() {
+	var (
+		configPath = flag.String("config", "", "read the configuration from this JSON `file`")
+		url        = flag.String("url", "", "upgrade `URL` of the gateway")
+		token      = flag.String("token", "", "bearer `token` sent to the gateway")
+		minBackoff = flag.Duration("min-backoff", 0, "minimum delay between reconnections (default 1s)")
+		maxBackoff = flag.Duration("max-backoff", 0, "maximum delay between reconnections (default 1m)")
+		ca         = flag.String("ca", "", "verify the gateway with the certificates of this PEM `file`")
+		cert       = flag.String("cert", "", "client certificate PEM `file`")
+		key        = flag.String("key", "", "client certificate key PEM `file`")
+		insecure   = flag.Bool("insecure", false, "don't verify the gateway's certificate")
+		logLevel   = flag.String("log-level", "", "log `level`: debug, info or error (default info)")
+		tunnels    tunnelFlags
+	)
+	flag.Var(&tunnels, "tunnel", "expose a target as `id=target`, where target is a port, host:port, URL, unix:socket or dir:directory (repeatable)")
+	flag.Parse()
+
+	c, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// flags override the configuration file
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "url":
+			c.URL = *url
+		case "token":
+			c.Token = *token
+		case "min-backoff":
+			c.MinBackoff = duration(*minBackoff)
+		case "max-backoff":
+			c.MaxBackoff = duration(*maxBackoff)
+		case "ca":
+			c.TLS.CA = *ca
+		case "cert":
+			c.TLS.Cert = *cert
+		case "key":
+			c.TLS.Key = *key
+		case "insecure":
+			c.TLS.Insecure = *insecure
+		case "log-level":
+			c.LogLevel = *logLevel
+		}
+	})
+	c.Tunnels = append(c.Tunnels, tunnels...)
+
+	if c.URL == "" {
+		log.Fatal("no gateway URL, use -url")
+	}
+	if len(c.Tunnels) == 0 {
+		log.Fatal("no tunnels, use -tunnel")
+	}
+
+	l, err := newLogger(c.LogLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	agents, err := newAgents(c, l)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	var wg sync.WaitGroup
+	for _, a := range agents {
+		wg.Add(1)
+		go func(a *reversehttp.Agent) {
+			defer wg.Done()
+			a.Run(ctx)
+		}(a)
+	}
+	wg.Wait()
+}
+
+// newAgents returns an Agent for every tunnel of c.
+func newAgents(c *config, l *logger) ([]*reversehttp.Agent, error) {
+	tlsConfig, err := c.TLS.tlsClientConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	agents := make([]*reversehttp.Agent, 0, len(c.Tunnels))
+	for _, t := range c.Tunnels {
+		if seen[t.ID] {
+			return nil, fmt.Errorf("tunnel %q is declared twice", t.ID)
+		}
+		seen[t.ID] = true
+
+		h, err := handler(t.Target)
+		if err != nil {
+			return nil, fmt.Errorf("tunnel %q: %v", t.ID, err)
+		}
+
+		header := http.Header{reversehttp.ClientIDHeader: {t.ID}}
+		if c.Token != "" {
+			header.Set("Authorization", "Bearer "+c.Token)
+		}
+
+		id := t.ID
+		agents = append(agents, &reversehttp.Agent{
+			URL:     c.URL,
+			Handler: logRequests(h, id, l),
+			Dialer: &reversehttp.Dialer{
+				Header:          header,
+				UserAgent:       "ptth-agent",
+				TLSClientConfig: tlsConfig,
+				Multiplex:       true,
+			},
+			MinBackoff: time.Duration(c.MinBackoff),
+			MaxBackoff: time.Duration(c.MaxBackoff),
+			OnStateChange: func(state reversehttp.AgentState, err error) {
+				switch {
+				case err != nil && state != reversehttp.StateStopped:
+					l.logf(levelError, "%s: %s: %v", id, state, err)
+				default:
+					l.logf(levelInfo, "%s: %s", id, state)
+				}
+			},
+		})
+	}
+	return agents, nil
+}
+
+// logRequests logs the requests served by h at the debug level.
+func logRequests(h http.Handler, id string, l *logger) http.Handler {
+	if l.level > levelDebug {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		h.ServeHTTP(w, r)
+		l.logf(levelDebug, "%s: %s %s (%v)", id, r.Method, r.URL, time.Since(start))
+	})
+}
@@ -0,0 +1,85 @@
+// Command ptth-gateway accepts Reverse HTTP connections from agents, such as
+// ptth-agent, and forwards public traffic to them.
+//
+// Agents connect to the agent address, and are registered under the ID they
+// ask for. Public requests are routed to the agent whose ID is their host
+// name, or the first segment of their path with -route path:
+//
+//	ptth-gateway -agent-addr :8443 -public-addr :80 -token secret \
+//		-admin-addr localhost:8081
+//
+// The admin address serves the list of connected agents and their statistics
+// as JSON at /agents.
+//
+// With -forward-host, a listener is opened on a free port of that host for
+// every service an agent declares with reversehttp.ForwardHeader. Its address
+// is logged, and listed with the agent's statistics.
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/petelliott/reversehttp"
+)
+
+func main() {
+	var (
+		agentAddr  = flag.String("agent-addr", ":8443", "`address` agents connect to")
+		publicAddr = flag.String("public-addr", ":8080", "`address` public traffic is served on")
+		adminAddr  = flag.String("admin-addr", "", "`address` of the admin endpoint, disabled if empty")
+		route      = flag.String("route", "host", "route public requests by `host` name or path prefix (path)")
+		token      = flag.String("token", os.Getenv("PTTH_TOKEN"), "bearer `token` agents must send (default $PTTH_TOKEN)")
+		heartbeat  = flag.Duration("heartbeat", 0, "interval of the heartbeats sent to agents, disabled if zero")
+		forward    = flag.String("forward-host", "", "`host` the services forwarded by agents are listened on, disabled if empty")
+		certFile   = flag.String("tls-cert", "", "serve agents and public traffic with TLS using this certificate PEM `file`")
+		keyFile    = flag.String("tls-key", "", "key PEM `file` of -tls-cert")
+	)
+	flag.Parse()
+
+	var routeFunc func(r *http.Request) (string, string)
+	switch *route {
+	case "host":
+		routeFunc = reversehttp.HostRoute
+	case "path":
+		routeFunc = reversehttp.PathRoute
+	default:
+		log.Fatalf("unknown route %q, expected host or path", *route)
+	}
+	if (*certFile == "") != (*keyFile == "") {
+		log.Fatal("-tls-cert and -tls-key must be used together")
+	}
+
+	g := newGateway(routeFunc, *token, *heartbeat)
+	if *forward != "" {
+		g.hub.ForwardListen = forwardListener(*forward)
+	}
+
+	listen := func(srv *http.Server) {
+		var err error
+		if *certFile != "" {
+			err = srv.ListenAndServeTLS(*certFile, *keyFile)
+		} else {
+			err = srv.ListenAndServe()
+		}
+		log.Fatal(err)
+	}
+
+	if *adminAddr != "" {
+		admin := http.NewServeMux()
+		admin.HandleFunc("/agents", g.serveAdmin)
+		go func() {
+			log.Fatal(http.ListenAndServe(*adminAddr, admin))
+		}()
+	}
+	// upgrades need HTTP/1.1
+	go listen(&http.Server{
+		Addr:         *agentAddr,
+		Handler:      g.hub,
+		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
+	})
+	listen(&http.Server{Addr: *publicAddr, Handler: g})
+}
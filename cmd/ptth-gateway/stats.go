@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/petelliott/reversehttp"
+)
+
+// agentStats are the statistics of a connected agent.
+type agentStats struct {
+	ID          string    `json:"id"`
+	RemoteAddr  string    `json:"remote_addr"`
+	AuthMethod  string    `json:"auth_method,omitempty"`
+	ConnectedAt time.Time `json:"connected_at"`
+	Requests    int64     `json:"requests"`
+	Active      int64     `json:"active"`
+	Failed      int64     `json:"failed"`
+	Forwards    []string  `json:"forwards,omitempty"`
+
+	// Listeners are the addresses the forwarded services are reachable
+	// at, by service.
+	Listeners map[string]string `json:"listeners,omitempty"`
+}
+
+// gateway routes public requests to the agents connected to its hub, and
+// keeps statistics about them.
+type gateway struct {
+	hub   *reversehttp.Hub
+	route func(r *http.Request) (string, string)
+	proxy *reversehttp.Gateway
+
+	mu    sync.Mutex
+	stats map[string]*agentStats
+}
+
+func newGateway(route func(r *http.Request) (string, string), token string, heartbeat time.Duration) *gateway {
+	g := &gateway{
+		route: route,
+		stats: make(map[string]*agentStats),
+	}
+	g.hub = &reversehttp.Hub{
+		OnConnect:    g.connected,
+		OnDisconnect: g.disconnected,
+	}
+	if token != "" {
+		g.hub.Authenticator = tokenAuth(token)
+	}
+	if heartbeat > 0 {
+		g.hub.Upgrader = &reversehttp.Upgrader{HeartbeatInterval: heartbeat}
+	}
+	g.proxy = &reversehttp.Gateway{Hub: g.hub, Route: route}
+	return g
+}
+
+// tokenAuth accepts agents with the bearer token, under the IDs they ask for.
+func tokenAuth(token string) reversehttp.Authenticator {
+	return reversehttp.AuthenticatorFunc(func(r *http.Request) (reversehttp.Identity, error) {
+		auth := r.Header.Get("Authorization")
+		if len(auth) < 7 || !strings.EqualFold(auth[:7], "bearer ") ||
+			subtle.ConstantTimeCompare([]byte(auth[7:]), []byte(token)) != 1 {
+			return reversehttp.Identity{}, reversehttp.ErrUnauthorized
+		}
+		return reversehttp.Identity{Method: "bearer"}, nil
+	})
+}
+
+// forwardListener returns a Hub.ForwardListen that listens on a free port of
+// host for every service agents forward.
+func forwardListener(host string) func(id, service string) (net.Listener, error) {
+	return func(id, service string) (net.Listener, error) {
+		l, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+		if err != nil {
+			log.Printf("%s: can't forward %s: %v", id, service, err)
+			return nil, err
+		}
+		log.Printf("%s: forwarding %s on %s", id, service, l.Addr())
+		return l, nil
+	}
+}
+
+func (g *gateway) connected(id string) {
+	s := &agentStats{
+		ID:          id,
+		ConnectedAt: time.Now().UTC(),
+	}
+	if c := g.hub.Conn(id); c != nil {
+		s.RemoteAddr = c.RemoteAddr().String()
+		s.Forwards = c.Forwards()
+	}
+	for service, addr := range g.hub.ForwardAddrs(id) {
+		if s.Listeners == nil {
+			s.Listeners = make(map[string]string)
+		}
+		s.Listeners[service] = addr.String()
+	}
+	if identity, ok := g.hub.Identity(id); ok {
+		s.AuthMethod = identity.Method
+	}
+
+	g.mu.Lock()
+	g.stats[id] = s
+	g.mu.Unlock()
+}
+
+func (g *gateway) disconnected(id string) {
+	g.mu.Lock()
+	delete(g.stats, id)
+	g.mu.Unlock()
+}
+
+// ServeHTTP serves public requests.
+func (g *gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id, _ := g.route(r)
+
+	g.mu.Lock()
+	s := g.stats[id]
+	g.mu.Unlock()
+	if s == nil {
+		g.proxy.ServeHTTP(w, r)
+		return
+	}
+
+	atomic.AddInt64(&s.Requests, 1)
+	atomic.AddInt64(&s.Active, 1)
+	defer atomic.AddInt64(&s.Active, -1)
+
+	sw := &statusWriter{ResponseWriter: w}
+	g.proxy.ServeHTTP(sw, r)
+	if sw.status == http.StatusBadGateway {
+		atomic.AddInt64(&s.Failed, 1)
+	}
+}
+
+// serveAdmin serves the list of connected agents as JSON.
+func (g *gateway) serveAdmin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	agents := make([]agentStats, 0)
+	for _, id := range g.hub.Clients() {
+		g.mu.Lock()
+		s := g.stats[id]
+		g.mu.Unlock()
+		if s == nil {
+			continue
+		}
+
+		agents = append(agents, agentStats{
+			ID:          s.ID,
+			RemoteAddr:  s.RemoteAddr,
+			AuthMethod:  s.AuthMethod,
+			ConnectedAt: s.ConnectedAt,
+			Requests:    atomic.LoadInt64(&s.Requests),
+			Active:      atomic.LoadInt64(&s.Active),
+			Failed:      atomic.LoadInt64(&s.Failed),
+			Forwards:    s.Forwards,
+			Listeners:   s.Listeners,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(map[string]interface{}{"agents": agents})
+}
+
+// statusWriter records the status of a response. It keeps the Flusher and
+// Hijacker of the ResponseWriter it wraps, which streamed and upgraded
+// responses need.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response can't be hijacked")
+	}
+	return h.Hijack()
+}
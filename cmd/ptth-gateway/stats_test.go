@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/petelliott/reversehttp"
+)
+
+func TestGateway(t *testing.T) {
+	g := newGateway(reversehttp.PathRoute, "secret", time.Minute)
+	g.hub.ForwardListen = forwardListener("127.0.0.1")
+	agents := httptest.NewServer(g.hub)
+	defer agents.Close()
+	defer g.hub.Close()
+	public := httptest.NewServer(g)
+	defer public.Close()
+	admin := httptest.NewServer(http.HandlerFunc(g.serveAdmin))
+	defer admin.Close()
+
+	// agents need the token
+	d := &reversehttp.Dialer{
+		Client: agents.Client(),
+		Header: http.Header{reversehttp.ClientIDHeader: {"web"}},
+	}
+	if _, err := d.Upgrade(context.Background(), agents.URL); err == nil {
+		t.Error("agent without a token was accepted")
+	}
+
+	d.Header.Set("Authorization", "Bearer secret")
+	d.Header.Set(reversehttp.ForwardHeader, "ssh")
+	d.Multiplex = true
+	go d.Reverse(context.Background(), agents.URL, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello " + r.URL.Path))
+	}))
+	for i := 0; i < 100 && len(g.hub.Clients()) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, path := range []string{"/web/a", "/web/b", "/missing/a"} {
+		resp, err := public.Client().Get(public.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if path != "/missing/a" && string(b) != "hello "+path[4:] {
+			t.Errorf("%s: got %q", path, b)
+		}
+	}
+
+	resp, err := admin.Client().Get(admin.URL + "/agents")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var list struct {
+		Agents []agentStats `json:"agents"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Agents) != 1 {
+		t.Fatalf("got agents %v", list.Agents)
+	}
+	a := list.Agents[0]
+	if a.ID != "web" || a.AuthMethod != "bearer" || a.Requests != 2 || a.Active != 0 ||
+		a.RemoteAddr == "" || len(a.Forwards) != 1 || a.Forwards[0] != "ssh" ||
+		a.Listeners["ssh"] == "" {
+		t.Errorf("got stats %+v", a)
+	}
+
+	resp, err = admin.Client().Post(admin.URL+"/agents", "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST got %s", resp.Status)
+	}
+}
@@ -0,0 +1,80 @@
+package reversehttp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// errNoDeadline is returned when setting a deadline on a bodyConn whose
+// underlying connection is not known.
+var errNoDeadline = errors.New("deadlines are not supported by this connection")
+
+// netConner is implemented by upgrade response bodies that know the
+// connection they are read from.
+type netConner interface {
+	netConn() net.Conn
+}
+
+// bodyConn is a net.Conn that reads from and writes to the body of an upgrade
+// response. Closing it closes the body. Deadlines and addresses are those of
+// the underlying connection, when the body knows it.
+type bodyConn struct {
+	io.ReadWriteCloser
+	conn net.Conn
+}
+
+func newBodyConn(body io.ReadWriteCloser) *bodyConn {
+	c := &bodyConn{ReadWriteCloser: body}
+	if nc, ok := body.(netConner); ok {
+		c.conn = nc.netConn()
+	}
+	return c
+}
+
+func (c *bodyConn) LocalAddr() net.Addr {
+	if c.conn != nil {
+		return c.conn.LocalAddr()
+	}
+	return addr("local")
+}
+
+func (c *bodyConn) RemoteAddr() net.Addr {
+	if c.conn != nil {
+		return c.conn.RemoteAddr()
+	}
+	return addr("remote")
+}
+
+func (c *bodyConn) SetDeadline(t time.Time) error {
+	if c.conn == nil {
+		return errNoDeadline
+	}
+	return c.conn.SetDeadline(t)
+}
+
+func (c *bodyConn) SetReadDeadline(t time.Time) error {
+	if c.conn == nil {
+		return errNoDeadline
+	}
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *bodyConn) SetWriteDeadline(t time.Time) error {
+	if c.conn == nil {
+		return errNoDeadline
+	}
+	return c.conn.SetWriteDeadline(t)
+}
+
+// dialedBody is the body of an upgrade response made by a Dialer, along with
+// the connection it was received on.
+type dialedBody struct {
+	io.ReadWriteCloser
+	conn net.Conn
+}
+
+func (b dialedBody) netConn() net.Conn {
+	return b.conn
+}
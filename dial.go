@@ -0,0 +1,171 @@
+package reversehttp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// StreamProtocol is the protocol of the requests made by ReverseConn.Dial,
+// which upgrade them to raw byte streams between the server and a
+// StreamListener of the client.
+const StreamProtocol = "PTTH-STREAM/1.0"
+
+// errStreamListenerClosed is returned by StreamListener.Accept once the
+// listener is closed.
+var errStreamListenerClosed = errors.New("stream listener is closed")
+
+// Dial opens a stream to the service of the client, which must be served by a
+// StreamListener of the client at the path "/" + service. The stream can
+// carry any protocol. ctx only limits the time taken to open it.
+//
+// On a multiplexed connection, the stream is one more stream of the
+// connection. Otherwise the whole connection becomes the stream, and no more
+// requests can be made on c.
+func (c *ReverseConn) Dial(ctx context.Context, service string) (net.Conn, error) {
+	req, err := http.NewRequest("GET", "http://ptth/"+service, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Upgrade", StreamProtocol)
+	req.Header.Set("Connection", "Upgrade")
+
+	resp, err := c.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		!headerHasToken(resp.Header, "Upgrade", StreamProtocol) {
+		return nil, fmt.Errorf("stream to %q: %w", service,
+			newUpgradeRejectedError(resp))
+	}
+	return newBodyConn(resp.Body.(io.ReadWriteCloser)), nil
+}
+
+// DialContext opens a stream to a service of a connected client, as
+// ReverseConn.Dial does. address is of the form "id:service". network is
+// ignored, so that DialContext can be used as the DialContext of an
+// http.Transport or other clients of TCP services.
+func (h *Hub) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	id, service, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	c := h.Conn(id)
+	if c == nil {
+		return nil, fmt.Errorf("no reverse http client with id %q", id)
+	}
+	return c.Dial(ctx, service)
+}
+
+// StreamListener is an http.Handler that accepts the streams opened by
+// ReverseConn.Dial, and a net.Listener that returns them, so that a client
+// can serve any protocol to the server. It has to be served at the path of
+// its service, for example:
+//
+//	l := reversehttp.NewStreamListener()
+//	mux := http.NewServeMux()
+//	mux.Handle("/rpc", l)
+//	go rpc.Accept(l)
+//	reversehttp.Reverse("http://example.com/ptth", mux)
+type StreamListener struct {
+	conns chan net.Conn
+
+	once sync.Once
+	done chan struct{}
+}
+
+// NewStreamListener returns a StreamListener that is ready to accept streams.
+func NewStreamListener() *StreamListener {
+	return &StreamListener{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+func (l *StreamListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-l.done:
+		http.Error(w, errStreamListenerClosed.Error(), http.StatusServiceUnavailable)
+		return
+	default:
+	}
+
+	c, err := acceptStream(w, r)
+	if err != nil {
+		return
+	}
+
+	select {
+	case l.conns <- c:
+	case <-l.done:
+		c.Close()
+	case <-r.Context().Done():
+		c.Close()
+	}
+}
+
+// acceptStream upgrades a request made by ReverseConn.Dial to a stream. If it
+// can't, the error is answered.
+func acceptStream(w http.ResponseWriter, r *http.Request) (net.Conn, error) {
+	if !headerHasToken(r.Header, "Upgrade", StreamProtocol) ||
+		!headerHasToken(r.Header, "Connection", "Upgrade") {
+		http.Error(w, "expected a stream upgrade", http.StatusBadRequest)
+		return nil, errors.New("request is not a stream upgrade")
+	}
+	hijacker := hijacker(w)
+	if hijacker == nil {
+		http.Error(w, "streams are not supported", http.StatusInternalServerError)
+		return nil, ErrHijackUnsupported
+	}
+
+	w.Header().Set("Upgrade", StreamProtocol)
+	w.Header().Set("Connection", "Upgrade")
+	w.WriteHeader(http.StatusSwitchingProtocols)
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	return &bufferedConn{conn, rw.Reader}, nil
+}
+
+// Accept waits for the next stream.
+func (l *StreamListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, errStreamListenerClosed
+	}
+}
+
+// Close stops the listener from accepting streams. Streams already accepted
+// are left open.
+func (l *StreamListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *StreamListener) Addr() net.Addr {
+	return addr("stream")
+}
+
+// bufferedConn is a net.Conn whose reads go through r, which holds whatever
+// was read from the connection before it was hijacked.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
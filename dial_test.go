@@ -0,0 +1,111 @@
+package reversehttp
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestHubDialContext(t *testing.T) {
+	for _, multiplex := range []bool{true, false} {
+		hub := new(Hub)
+		connected := watchHub(hub)
+		srv := httptest.NewServer(hub)
+
+		l := NewStreamListener()
+		go func() {
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					io.Copy(c, c)
+					c.Close()
+				}()
+			}
+		}()
+
+		mux := http.NewServeMux()
+		mux.Handle("/echo", l)
+		d := &Dialer{
+			Client:    srv.Client(),
+			Header:    http.Header{ClientIDHeader: {"agent"}},
+			Multiplex: multiplex,
+		}
+		_, result := connectHub(t, d, srv.URL, mux)
+		<-connected
+		conn := hub.Conn("agent")
+
+		_, err := hub.DialContext(context.Background(), "tcp", "missing:echo")
+		if err == nil {
+			t.Error("dialed a missing client")
+		}
+		_, err = hub.DialContext(context.Background(), "tcp", "agent:other")
+		if err == nil {
+			t.Error("dialed a missing service")
+		}
+
+		// multiplexed streams are independent of each other, otherwise the
+		// connection becomes the stream
+		n := 1
+		if multiplex {
+			n = 5
+		}
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				c, err := hub.DialContext(context.Background(), "tcp", "agent:echo")
+				if !expect(t, nil, err) {
+					return
+				}
+				_, err = c.Write([]byte("hello world\n"))
+				expect(t, nil, err)
+				b := make([]byte, 12)
+				_, err = io.ReadFull(c, b)
+				expect(t, nil, err)
+				expect(t, "hello world\n", string(b))
+				c.Close()
+			}()
+		}
+		wg.Wait()
+
+		if !multiplex {
+			_, err = conn.Client().Get("http://agent/")
+			if err == nil {
+				t.Error("request made on a connection used by a stream")
+			}
+		}
+
+		l.Close()
+		_, err = l.Accept()
+		expect(t, errStreamListenerClosed, err)
+
+		hub.Close()
+		<-result
+		srv.Close()
+	}
+}
+
+func TestStreamListenerRejects(t *testing.T) {
+	l := NewStreamListener()
+	w := httptest.NewRecorder()
+	l.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	expect(t, http.StatusBadRequest, w.Code)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Upgrade", StreamProtocol)
+	r.Header.Set("Connection", "Upgrade")
+	w = httptest.NewRecorder()
+	l.ServeHTTP(w, r)
+	expect(t, http.StatusInternalServerError, w.Code)
+	b, _ := ioutil.ReadAll(w.Body)
+	expect(t, "streams are not supported\n", string(b))
+}
@@ -0,0 +1,263 @@
+package reversehttp
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errHTTP2Body is returned when a Dialer is given both HTTP2 and a Body.
+var errHTTP2Body = errors.New("an upgrade request body can't be sent over HTTP/2")
+
+// Dialer holds the options used to make Reverse HTTP upgrade requests, so that
+// agents with different settings can run in one process without touching
+// http.DefaultClient. The zero value makes the same requests as Reverse.
+type Dialer struct {
+	// Client makes the upgrade requests. If nil, http.DefaultClient is used,
+	// unless TLSClientConfig is set.
+	Client *http.Client
+
+	// Method is the method of the upgrade request. It defaults to POST.
+	Method string
+
+	// Body, if not empty, is sent as the body of the upgrade request. It
+	// can't be sent over HTTP/2, where the body carries the connection.
+	Body []byte
+
+	// Header holds extra headers sent with the upgrade request, such as
+	// ClientIDHeader.
+	Header http.Header
+
+	// UserAgent, if not empty, is sent as the User-Agent of the upgrade
+	// request.
+	UserAgent string
+
+	// TLSClientConfig, if not nil and Client is nil, is used to make the
+	// upgrade requests to https URLs.
+	TLSClientConfig *tls.Config
+
+	// Prepare, if not nil, is called with every upgrade request before it is
+	// sent, for example to sign it with SignHMAC.
+	Prepare func(r *http.Request) error
+
+	// Protocols, if not empty, are the versions of the protocol offered to
+	// the server, in the order they are sent. The server picks one by its
+	// own preference, but servers that only support PTTH/1.0 may only look
+	// at the first. It defaults to every supported version, PTTH/1.0 first.
+	Protocols []string
+
+	// Multiplex offers MuxProtocol to the server. If the server accepts, its
+	// requests are served concurrently, each on its own stream.
+	Multiplex bool
+
+	// HTTP2 makes the upgrade request as an HTTP/2 request, whose body and
+	// response body carry the connection. It must be made with HTTP/2, so
+	// the Client must support it: the one built from TLSClientConfig does.
+	HTTP2 bool
+
+	// HandshakeTimeout limits the time taken by the upgrade request. Zero
+	// means no limit.
+	HandshakeTimeout time.Duration
+
+	once   sync.Once
+	client *http.Client
+}
+
+func (d *Dialer) httpClient() *http.Client {
+	d.once.Do(func() {
+		switch {
+		case d.Client != nil:
+			d.client = d.Client
+		case d.TLSClientConfig != nil:
+			d.client = &http.Client{
+				Transport: &http.Transport{
+					Proxy: http.ProxyFromEnvironment,
+					DialContext: (&net.Dialer{
+						Timeout:   30 * time.Second,
+						KeepAlive: 30 * time.Second,
+					}).DialContext,
+					TLSClientConfig:     d.TLSClientConfig,
+					TLSHandshakeTimeout: 10 * time.Second,
+					ForceAttemptHTTP2:   d.HTTP2,
+				},
+			}
+		default:
+			d.client = http.DefaultClient
+		}
+	})
+	return d.client
+}
+
+// upgrade makes the upgrade request to url and returns the response as is.
+func (d *Dialer) upgrade(ctx context.Context, url string) (*http.Response, error) {
+	method := d.Method
+	if method == "" {
+		method = "POST"
+	}
+	var body io.Reader
+	if len(d.Body) > 0 {
+		if d.HTTP2 {
+			return nil, errHTTP2Body
+		}
+		body = bytes.NewReader(d.Body)
+	}
+	req, err := NewUpgradeRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range d.Header {
+		req.Header[k] = append(req.Header[k], v...)
+	}
+	if len(d.Protocols) > 0 {
+		req.Header["Upgrade"] = append([]string(nil), d.Protocols...)
+	}
+	if d.Multiplex {
+		req.Header.Add("Upgrade", MuxProtocol)
+	}
+
+	// over HTTP/2, the request body is the client's half of the connection
+	var pw *io.PipeWriter
+	if d.HTTP2 {
+		for _, v := range req.Header["Upgrade"] {
+			req.Header.Add(HTTP2UpgradeHeader, v)
+		}
+		req.Header.Del("Upgrade")
+		req.Header.Del("Connection")
+
+		var pr *io.PipeReader
+		pr, pw = io.Pipe()
+		req.Body = pr
+		req.ContentLength = -1
+	}
+	if d.UserAgent != "" {
+		req.Header.Set("User-Agent", d.UserAgent)
+	}
+	if d.Prepare != nil {
+		if err := d.Prepare(req); err != nil {
+			return nil, err
+		}
+	}
+
+	// the timeout stops once the response headers have arrived: over
+	// HTTP/2, the response body ends as soon as the request context does
+	cancel := func() {}
+	var timer *time.Timer
+	if d.HandshakeTimeout > 0 {
+		ctx, cancel = context.WithCancel(ctx)
+		timer = time.AfterFunc(d.HandshakeTimeout, cancel)
+	}
+
+	// remember the connection the request is sent on, so that the upgraded
+	// body can expose it
+	var conn net.Conn
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			conn = info.Conn
+		},
+	})
+
+	resp, err := d.httpClient().Do(req.WithContext(ctx))
+	if timer != nil {
+		timer.Stop()
+	}
+	if err != nil {
+		cancel()
+		if pw != nil {
+			pw.Close()
+		}
+		return nil, err
+	}
+	if pw != nil {
+		if !IsReverseHTTPResponse(resp) {
+			pw.Close()
+		}
+		resp.Body = h2Body{resp.Body, pw, cancel}
+		return resp, nil
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		// the body of a rejection is read once the request has returned
+		resp.Body = cancelBody{resp.Body, cancel}
+		return resp, nil
+	}
+	cancel()
+	if body, ok := resp.Body.(io.ReadWriteCloser); ok && conn != nil {
+		resp.Body = dialedBody{body, conn}
+	}
+	return resp, nil
+}
+
+// cancelBody is the body of a response whose request context is cancelled
+// once it is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel func()
+}
+
+func (b cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// Upgrade makes a Reverse HTTP upgrade request to url and returns the
+// server's upgrade response, which can be passed to ReverseResponse. The
+// version of the protocol the server picked is given by ResponseProtocol. An
+// error is returned if the server does not upgrade the connection. It is an
+// *UpgradeRejectedError if the server answered with anything else, including
+// a version that was not offered.
+func (d *Dialer) Upgrade(ctx context.Context, url string) (*http.Response, error) {
+	resp, err := d.upgrade(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := d.check(resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// check returns an *UpgradeRejectedError, after closing the body of resp,
+// unless resp upgrades the connection to a version of the protocol that d
+// offered.
+func (d *Dialer) check(resp *http.Response) error {
+	if !d.offered(ResponseProtocol(resp)) {
+		return newUpgradeRejectedError(resp)
+	}
+	return nil
+}
+
+// offered reports whether the version proto was offered to the server.
+func (d *Dialer) offered(proto string) bool {
+	if proto == "" {
+		return false
+	}
+	if len(d.Protocols) == 0 {
+		return true
+	}
+	for _, p := range d.Protocols {
+		if strings.EqualFold(p, proto) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reverse makes a Reverse HTTP request to url, and then serves the requests
+// made over the upgraded connection with handler, as ReverseResponseContext
+// does.
+func (d *Dialer) Reverse(ctx context.Context, url string, handler http.Handler) error {
+	resp, err := d.Upgrade(ctx, url)
+	if err != nil {
+		return err
+	}
+	return ReverseResponseContext(ctx, resp, handler)
+}
@@ -0,0 +1,87 @@
+package reversehttp
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDialerOptions(t *testing.T) {
+	endserver := make(chan struct{})
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		expect(t, "GET", r.Method)
+		expect(t, "test-agent/1.0", r.Header.Get("User-Agent"))
+		expect(t, "agent", r.Header.Get(ClientIDHeader))
+
+		c, err := ReverseRequest(w, r)
+		expect(t, nil, err)
+
+		// outlive the handshake timeout, which must not affect the connection
+		time.Sleep(300 * time.Millisecond)
+
+		req, err := http.NewRequest("GET", "http://example.com/path", nil)
+		expect(t, nil, err)
+		req.Close = true
+		resp, err := c.Do(req)
+		if expect(t, nil, err) {
+			b, err := ioutil.ReadAll(resp.Body)
+			expect(t, nil, err)
+			expect(t, "hello world\n", string(b))
+		}
+
+		close(endserver)
+	}))
+	defer srv.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+
+	d := &Dialer{
+		Method:           "GET",
+		Header:           http.Header{ClientIDHeader: {"agent"}},
+		UserAgent:        "test-agent/1.0",
+		TLSClientConfig:  &tls.Config{RootCAs: pool},
+		HandshakeTimeout: 200 * time.Millisecond,
+	}
+	err := d.Reverse(context.Background(), srv.URL, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello world\n"))
+	}))
+	if expect(t, nil, err) {
+		<-endserver
+	}
+}
+
+func TestDialerUpgrade(t *testing.T) {
+	hang := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/hang" {
+			<-hang
+		}
+		http.Error(w, "no", http.StatusForbidden)
+	}))
+	defer srv.Close()
+	defer close(hang)
+
+	d := &Dialer{Client: srv.Client()}
+	_, err := d.Upgrade(context.Background(), srv.URL)
+	if err == nil {
+		t.Error("rejected upgrade did not fail")
+	}
+
+	_, err = d.Upgrade(context.Background(), "asdkjfklvqnvnon  idga %%2")
+	if err == nil {
+		t.Error("invalid url did not fail")
+	}
+
+	d = &Dialer{Client: srv.Client(), HandshakeTimeout: 10 * time.Millisecond}
+	_, err = d.Upgrade(context.Background(), srv.URL+"/hang")
+	if err == nil {
+		t.Error("handshake did not time out")
+	}
+}
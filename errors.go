@@ -0,0 +1,70 @@
+package reversehttp
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+var (
+	// ErrNotReverseRequest is returned when upgrading a request that is not
+	// a Reverse HTTP upgrade request.
+	ErrNotReverseRequest = errors.New("request is not a valid reverse http request")
+
+	// ErrUpgradeRejected is matched by the UpgradeRejectedError returned
+	// when a server does not upgrade a connection.
+	ErrUpgradeRejected = errors.New("reverse http upgrade rejected")
+
+	// ErrConnectionClosed is returned for requests made on a reverse
+	// connection that can no longer carry them.
+	ErrConnectionClosed = errors.New("reverse http connection is closed")
+
+	// ErrHijackUnsupported is returned when upgrading a request whose
+	// http.ResponseWriter can't be hijacked.
+	ErrHijackUnsupported = errors.New("response writer does not support hijacking")
+)
+
+// maxRejectedBody is how much of the body of a rejected upgrade is kept.
+const maxRejectedBody = 64 << 10
+
+// UpgradeRejectedError is returned when a server answers an upgrade request
+// with something other than a Reverse HTTP upgrade. It matches
+// ErrUpgradeRejected with errors.Is.
+type UpgradeRejectedError struct {
+	// StatusCode and Status are those of the server's response.
+	StatusCode int
+	Status     string
+
+	// Body holds the beginning of the response's body, which usually
+	// explains the rejection.
+	Body []byte
+}
+
+// newUpgradeRejectedError reads the body of resp, which it closes, into an
+// UpgradeRejectedError.
+func newUpgradeRejectedError(resp *http.Response) *UpgradeRejectedError {
+	e := &UpgradeRejectedError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+	}
+	if e.Status == "" {
+		e.Status = http.StatusText(resp.StatusCode)
+	}
+	if resp.Body != nil {
+		// the body of a switching protocols response is the connection
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			e.Body, _ = ioutil.ReadAll(io.LimitReader(resp.Body, maxRejectedBody))
+		}
+		resp.Body.Close()
+	}
+	return e
+}
+
+func (e *UpgradeRejectedError) Error() string {
+	return "reverse http upgrade rejected: " + e.Status
+}
+
+func (e *UpgradeRejectedError) Is(target error) bool {
+	return target == ErrUpgradeRejected
+}
@@ -0,0 +1,78 @@
+package reversehttp
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUpgradeRejectedError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		w.(http.Flusher).Flush()
+		// the body arrives after the response headers
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("not today\n"))
+	}))
+	defer srv.Close()
+
+	// the handshake timeout does not cut the body short
+	for _, timeout := range []time.Duration{0, time.Minute} {
+		d := &Dialer{Client: srv.Client(), HandshakeTimeout: timeout}
+		_, err := d.Upgrade(context.Background(), srv.URL)
+		expect(t, true, errors.Is(err, ErrUpgradeRejected))
+		var rejected *UpgradeRejectedError
+		if expect(t, true, errors.As(err, &rejected)) {
+			expect(t, http.StatusForbidden, rejected.StatusCode)
+			expect(t, "403 Forbidden", rejected.Status)
+			expect(t, "not today\n", string(rejected.Body))
+			expect(t, "reverse http upgrade rejected: 403 Forbidden", err.Error())
+		}
+	}
+
+	err := ReverseResponse(&http.Response{StatusCode: http.StatusOK}, http.NotFoundHandler())
+	expect(t, true, errors.Is(err, ErrUpgradeRejected))
+	err = ReverseResponse(nil, http.NotFoundHandler())
+	expect(t, true, errors.Is(err, ErrUpgradeRejected))
+}
+
+func TestUpgradeErrors(t *testing.T) {
+	w := httptest.NewRecorder()
+	_, err := Upgrade(w, httptest.NewRequest("GET", "/", nil))
+	expect(t, ErrNotReverseRequest, err)
+
+	// nothing is written to writers that can't be hijacked
+	r := httptest.NewRequest("POST", "/", nil)
+	r.Header.Set("Upgrade", "PTTH/1.0")
+	r.Header.Set("Connection", "Upgrade")
+	_, err = Upgrade(w, r)
+	expect(t, ErrHijackUnsupported, err)
+	expect(t, false, w.Flushed)
+	expect(t, "", w.Header().Get("Upgrade"))
+}
+
+func TestConnectionClosedError(t *testing.T) {
+	for _, multiplex := range []bool{false, true} {
+		conns := make(chan *ReverseConn, 1)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c, err := Upgrade(w, r)
+			expect(t, nil, err)
+			conns <- c
+		}))
+
+		d := &Dialer{Client: srv.Client(), Multiplex: multiplex}
+		go d.Reverse(context.Background(), srv.URL, http.NotFoundHandler())
+		c := <-conns
+		c.Close()
+		<-c.Done()
+
+		_, err := c.Client().Get("http://example.com/")
+		expect(t, true, errors.Is(err, ErrConnectionClosed))
+		expect(t, true, strings.Contains(err.Error(), ErrConnectionClosed.Error()))
+		srv.Close()
+	}
+}
@@ -0,0 +1,196 @@
+package reversehttp
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ForwardHeader is the header a client sets on its upgrade request to declare
+// the services of its Forwarder. ReverseConn.Forwards returns them.
+const ForwardHeader = "Ptth-Forward"
+
+// defaultForwardDialTimeout is the default of Forwarder.DialTimeout.
+const defaultForwardDialTimeout = 10 * time.Second
+
+// Forwarder is an http.Handler for clients that forwards the streams opened
+// by ReverseConn.Dial to local TCP addresses, like ssh -R does. The service
+// of a stream is the path it is opened at, without its leading slash.
+//
+// Along with Hub.ForwardListen or Hub.Forward, it makes services such as SSH or
+// databases behind a NAT reachable through the server:
+//
+//	f := &reversehttp.Forwarder{Targets: map[string]string{"ssh": "localhost:22"}}
+//	d := &reversehttp.Dialer{Header: f.Header(), Multiplex: true}
+//	d.Reverse(ctx, "http://example.com/ptth", f)
+type Forwarder struct {
+	// Targets maps the services to the addresses they are forwarded to.
+	Targets map[string]string
+
+	// DialTimeout limits the time taken to connect to a target. It defaults
+	// to 10 seconds.
+	DialTimeout time.Duration
+}
+
+// Services returns the services of f in sorted order.
+func (f *Forwarder) Services() []string {
+	services := make([]string, 0, len(f.Targets))
+	for service := range f.Targets {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+	return services
+}
+
+// Header returns the header declaring the services of f, to be added to the
+// upgrade request.
+func (f *Forwarder) Header() http.Header {
+	return http.Header{ForwardHeader: {strings.Join(f.Services(), ", ")}}
+}
+
+func (f *Forwarder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	target, ok := f.Targets[strings.TrimPrefix(r.URL.Path, "/")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	timeout := f.DialTimeout
+	if timeout <= 0 {
+		timeout = defaultForwardDialTimeout
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", target)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	stream, err := acceptStream(w, r)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go join(stream, conn)
+}
+
+// Forwards returns the services the client declared with ForwardHeader.
+func (c *ReverseConn) Forwards() []string {
+	var services []string
+	for _, v := range c.req.Header[http.CanonicalHeaderKey(ForwardHeader)] {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				services = append(services, s)
+			}
+		}
+	}
+	return services
+}
+
+// Forward accepts connections on l and forwards each of them to the service
+// at address, which is of the form "id:service" as for DialContext. It
+// returns the error of l.Accept, once l is closed for example. Connections
+// that can't be forwarded are closed.
+func (h *Hub) Forward(l net.Listener, address string) error {
+	return forward(l, func(ctx context.Context) (net.Conn, error) {
+		return h.DialContext(ctx, "tcp", address)
+	})
+}
+
+// ForwardAddrs returns the addresses of the listeners opened by ForwardListen
+// for the services of the client connected with id, by service.
+func (h *Hub) ForwardAddrs(id string) map[string]net.Addr {
+	c := h.Conn(id)
+	if c == nil {
+		return nil
+	}
+
+	addrs := make(map[string]net.Addr, len(c.listeners))
+	for service, l := range c.listeners {
+		addrs[service] = l.Addr()
+	}
+	return addrs
+}
+
+// openForwards opens a listener with ForwardListen for every service c
+// declared, and forwards the connections accepted on them to c. Services
+// whose listener can't be opened are not forwarded, and neither are those of
+// a connection that isn't multiplexed.
+func (h *Hub) openForwards(id string, c *ReverseConn) {
+	if h.ForwardListen == nil {
+		return
+	}
+	if _, ok := c.t.(*muxTripper); !ok {
+		return
+	}
+
+	c.listeners = make(map[string]net.Listener)
+	for _, service := range c.Forwards() {
+		if c.listeners[service] != nil {
+			continue
+		}
+		l, err := h.ForwardListen(id, service)
+		if err != nil {
+			continue
+		}
+		c.listeners[service] = l
+
+		service := service
+		go forward(l, func(ctx context.Context) (net.Conn, error) {
+			return c.Dial(ctx, service)
+		})
+	}
+}
+
+// closeForwards closes the listeners opened by openForwards.
+func closeForwards(c *ReverseConn) {
+	for _, l := range c.listeners {
+		l.Close()
+	}
+}
+
+// forward accepts connections on l, and joins each of them with a stream
+// opened by dial. It returns the error of l.Accept.
+func forward(l net.Listener, dial func(ctx context.Context) (net.Conn, error)) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			stream, err := dial(context.Background())
+			if err != nil {
+				conn.Close()
+				return
+			}
+			join(conn, stream)
+		}()
+	}
+}
+
+// join copies between a and b in both directions, and closes both once
+// either direction ends.
+func join(a, b net.Conn) {
+	var once sync.Once
+	closeBoth := func() {
+		once.Do(func() {
+			a.Close()
+			b.Close()
+		})
+	}
+
+	go func() {
+		io.Copy(a, b)
+		closeBoth()
+	}()
+	io.Copy(b, a)
+	closeBoth()
+}
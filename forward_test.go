@@ -0,0 +1,163 @@
+package reversehttp
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// echoServer starts a TCP service that echoes what it receives, as a local
+// service behind a client.
+func echoServer(t *testing.T) net.Listener {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return target
+}
+
+func TestForward(t *testing.T) {
+	target := echoServer(t)
+	defer target.Close()
+
+	hub := new(Hub)
+	connected := watchHub(hub)
+	srv := httptest.NewServer(hub)
+	defer srv.Close()
+	defer hub.Close()
+
+	f := &Forwarder{Targets: map[string]string{
+		"echo": target.Addr().String(),
+		"down": "127.0.0.1:1",
+	}}
+	expect(t, []string{"down", "echo"}, f.Services())
+
+	h := f.Header()
+	h.Set(ClientIDHeader, "agent")
+	d := &Dialer{Client: srv.Client(), Header: h, Multiplex: true}
+	connectHub(t, d, srv.URL, f)
+	<-connected
+	expect(t, []string{"down", "echo"}, hub.Conn("agent").Forwards())
+
+	for _, service := range []string{"echo", "down", "missing"} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if !expect(t, nil, err) {
+			return
+		}
+		go hub.Forward(l, "agent:"+service)
+
+		c, err := net.Dial("tcp", l.Addr().String())
+		if !expect(t, nil, err) {
+			return
+		}
+		c.Write([]byte("hello world\n"))
+		b := make([]byte, 12)
+		_, err = io.ReadFull(c, b)
+		if service == "echo" {
+			expect(t, nil, err)
+			expect(t, "hello world\n", string(b))
+		} else if err == nil {
+			t.Errorf("connection to %s was not closed", service)
+		}
+		c.Close()
+		l.Close()
+	}
+}
+
+func TestHubForwardListen(t *testing.T) {
+	target := echoServer(t)
+	defer target.Close()
+
+	disconnected := make(chan string, 1)
+	hub := &Hub{
+		ForwardListen: func(id, service string) (net.Listener, error) {
+			expect(t, "agent", id)
+			return net.Listen("tcp", "127.0.0.1:0")
+		},
+		OnDisconnect: func(id string) {
+			disconnected <- id
+		},
+	}
+	connected := watchHub(hub)
+	srv := httptest.NewServer(hub)
+	defer srv.Close()
+
+	f := &Forwarder{Targets: map[string]string{"echo": target.Addr().String()}}
+	h := f.Header()
+	h.Set(ClientIDHeader, "agent")
+	d := &Dialer{Client: srv.Client(), Header: h, Multiplex: true}
+	connectHub(t, d, srv.URL, f)
+	<-connected
+
+	// a listener is opened for the declared service
+	addrs := hub.ForwardAddrs("agent")
+	expect(t, 1, len(addrs))
+	addr := addrs["echo"]
+	if addr == nil {
+		t.Fatal("no listener for the echo service")
+	}
+	c, err := net.Dial("tcp", addr.String())
+	if !expect(t, nil, err) {
+		return
+	}
+	c.Write([]byte("hello world\n"))
+	b := make([]byte, 12)
+	_, err = io.ReadFull(c, b)
+	expect(t, nil, err)
+	expect(t, "hello world\n", string(b))
+	c.Close()
+
+	// and closed once the client disconnects
+	hub.Close()
+	<-disconnected
+	deadline := time.Now().Add(time.Second)
+	for {
+		c, err = net.Dial("tcp", addr.String())
+		if err != nil {
+			break
+		}
+		c.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("listener is still open after the client disconnected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// a connection that isn't multiplexed gets no listeners, as a stream
+	// would take it over
+	d = &Dialer{Client: srv.Client(), Header: h}
+	_, result := connectHub(t, d, srv.URL, f)
+	<-connected
+	expect(t, 0, len(hub.ForwardAddrs("agent")))
+	expect(t, []string{"echo"}, hub.Conn("agent").Forwards())
+	hub.Close()
+	<-disconnected
+	<-result
+}
+
+func TestForwarderErrors(t *testing.T) {
+	f := &Forwarder{Targets: map[string]string{"down": "127.0.0.1:1"}}
+
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, httptest.NewRequest("GET", "/missing", nil))
+	expect(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	f.ServeHTTP(w, httptest.NewRequest("GET", "/down", nil))
+	expect(t, http.StatusBadGateway, w.Code)
+}
@@ -0,0 +1,111 @@
+package reversehttp
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+)
+
+// Gateway is an http.Handler that forwards ordinary HTTP requests to the
+// clients connected to a Hub, and streams their responses back.
+//
+// Hop-by-hop headers are removed in both directions, and the X-Forwarded-For,
+// X-Forwarded-Proto and X-Forwarded-Host headers are set on forwarded
+// requests. Requests that cannot be routed to a connected client are answered
+// with 502 Bad Gateway.
+type Gateway struct {
+	// Hub holds the clients requests are forwarded to.
+	Hub *Hub
+
+	// Route returns the ID of the client r is forwarded to and the path it is
+	// forwarded with. If Route is nil, HostRoute is used.
+	Route func(r *http.Request) (id, path string)
+
+	// ErrorLog specifies an optional logger for errors that occur when
+	// forwarding requests. If nil, logging goes to os.Stderr via the log
+	// package's standard logger.
+	ErrorLog *log.Logger
+}
+
+// HostRoute routes a request to the client whose ID is the request's host,
+// without any port, and leaves its path unchanged.
+func HostRoute(r *http.Request) (string, string) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return host, r.URL.Path
+}
+
+// PathRoute routes a request to the client whose ID is the first segment of
+// the request's path, which is removed. For example "/a/b/c" is forwarded to
+// client "a" as "/b/c".
+func PathRoute(r *http.Request) (string, string) {
+	p := strings.TrimPrefix(r.URL.Path, "/")
+	i := strings.Index(p, "/")
+	if i < 0 {
+		return p, "/"
+	}
+	return p[:i], p[i:]
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	route := g.Route
+	if route == nil {
+		route = HostRoute
+	}
+
+	id, path := route(r)
+	var c *ReverseConn
+	if id != "" {
+		c = g.Hub.Conn(id)
+	}
+	if c == nil {
+		http.Error(w, "no reverse http client for this request",
+			http.StatusBadGateway)
+		return
+	}
+
+	direct := func(out *http.Request) {
+		forwardDirector(out, r, path)
+	}
+	reverseProxy(direct, c, g.ErrorLog).ServeHTTP(w, r)
+}
+
+// reverseProxy returns a ReverseProxy that sends requests rewritten by direct
+// with transport, and streams the responses back without buffering them.
+// X-Forwarded-Host is set to the Host of the inbound request.
+func reverseProxy(direct func(*http.Request), transport http.RoundTripper, errorLog *log.Logger) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Director: func(out *http.Request) {
+			out.Header.Set("X-Forwarded-Host", out.Host)
+			direct(out)
+
+			// don't let the Go user agent be added
+			if _, ok := out.Header["User-Agent"]; !ok {
+				out.Header.Set("User-Agent", "")
+			}
+		},
+		Transport:     transport,
+		FlushInterval: -1,
+		ErrorLog:      errorLog,
+	}
+}
+
+// forwardDirector rewrites out, a copy of the inbound request r, to be sent
+// to a reverse client with path. httputil.ReverseProxy takes care of hop-by-hop
+// headers and X-Forwarded-For.
+func forwardDirector(out *http.Request, r *http.Request, path string) {
+	out.URL.Scheme = "http"
+	out.URL.Host = r.Host
+	out.URL.Path = path
+	out.URL.RawPath = ""
+
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	out.Header.Set("X-Forwarded-Proto", proto)
+}
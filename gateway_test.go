@@ -0,0 +1,89 @@
+package reversehttp
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRoutes(t *testing.T) {
+	r := httptest.NewRequest("GET", "http://agent:8080/a/b/c", nil)
+
+	id, path := HostRoute(r)
+	expect(t, "agent", id)
+	expect(t, "/a/b/c", path)
+
+	id, path = PathRoute(r)
+	expect(t, "a", id)
+	expect(t, "/b/c", path)
+
+	r = httptest.NewRequest("GET", "http://agent/a", nil)
+	id, path = PathRoute(r)
+	expect(t, "a", id)
+	expect(t, "/", path)
+}
+
+func TestGateway(t *testing.T) {
+	hub := new(Hub)
+	connected := watchHub(hub)
+	agents := httptest.NewServer(hub)
+	defer agents.Close()
+	defer hub.Close()
+
+	gw := &Gateway{Hub: hub, Route: PathRoute}
+	public := httptest.NewServer(gw)
+	defer public.Close()
+
+	d := &Dialer{
+		Client: agents.Client(),
+		Header: http.Header{ClientIDHeader: {"a"}},
+	}
+	connectHub(t, d, agents.URL, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		expect(t, "/path", r.URL.Path)
+		expect(t, "x=1", r.URL.RawQuery)
+		expect(t, strings.TrimPrefix(public.URL, "http://"), r.Host)
+		expect(t, "127.0.0.1", r.Header.Get("X-Forwarded-For"))
+		expect(t, "http", r.Header.Get("X-Forwarded-Proto"))
+		expect(t, r.Host, r.Header.Get("X-Forwarded-Host"))
+		expect(t, "", r.Header.Get("X-Hop"))
+		expect(t, "", r.Header.Get("Keep-Alive"))
+
+		w.Header().Set("Connection", "X-Hop")
+		w.Header().Set("X-Hop", "1")
+		w.Header().Set("Content-Type", "text/plain")
+		b, err := ioutil.ReadAll(r.Body)
+		expect(t, nil, err)
+		w.Write(b)
+	}))
+	<-connected
+
+	req, err := http.NewRequest("POST", public.URL+"/a/path?x=1",
+		strings.NewReader("hello world\n"))
+	expect(t, nil, err)
+	req.Header.Set("Connection", "X-Hop")
+	req.Header.Set("X-Hop", "1")
+	req.Header.Set("Keep-Alive", "timeout=5")
+
+	// more requests than one, to check the connection is reused
+	for i := 0; i < 3; i++ {
+		req.Body = ioutil.NopCloser(strings.NewReader("hello world\n"))
+		resp, err := public.Client().Do(req)
+		if !expect(t, nil, err) {
+			return
+		}
+		expect(t, http.StatusOK, resp.StatusCode)
+		expect(t, "text/plain", resp.Header.Get("Content-Type"))
+		expect(t, "", resp.Header.Get("X-Hop"))
+		b, err := ioutil.ReadAll(resp.Body)
+		expect(t, nil, err)
+		expect(t, "hello world\n", string(b))
+		resp.Body.Close()
+	}
+
+	resp, err := public.Client().Get(public.URL + "/b/path")
+	expect(t, nil, err)
+	expect(t, http.StatusBadGateway, resp.StatusCode)
+	resp.Body.Close()
+}
@@ -0,0 +1,195 @@
+package reversehttp
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HTTP2UpgradeHeader replaces the Upgrade header, which HTTP/2 does not
+// allow, in Reverse HTTP requests and responses made over HTTP/2. Such
+// requests are answered with 200 OK, and the connection is then carried by
+// the request and response bodies, which HTTP/2 streams in both directions
+// at once.
+const HTTP2UpgradeHeader = "Ptth-Upgrade"
+
+// upgradeHeader returns the header listing the protocols a message upgrades
+// to, for a message of the given major version.
+func upgradeHeader(protoMajor int) string {
+	if protoMajor == 2 {
+		return HTTP2UpgradeHeader
+	}
+	return "Upgrade"
+}
+
+// hijacker returns the http.Hijacker of w, which may be wrapped by other
+// ResponseWriters that have an Unwrap method, as http.ResponseController
+// expects. It returns nil if there is none.
+func hijacker(w http.ResponseWriter) http.Hijacker {
+	for {
+		if h, ok := w.(http.Hijacker); ok {
+			return h
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return nil
+		}
+		w = u.Unwrap()
+	}
+}
+
+// flusher returns the http.Flusher of w, unwrapping it as hijacker does.
+func flusher(w http.ResponseWriter) http.Flusher {
+	for {
+		if f, ok := w.(http.Flusher); ok {
+			return f
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return nil
+		}
+		w = u.Unwrap()
+	}
+}
+
+// h2Conn is the server side of a Reverse HTTP connection carried by the
+// bodies of an HTTP/2 request and its response.
+type h2Conn struct {
+	body   io.ReadCloser
+	w      io.Writer
+	f      http.Flusher
+	remote net.Addr
+
+	mu       sync.Mutex
+	closed   bool
+	timedOut bool
+	timer    *time.Timer
+	done     chan struct{}
+
+	// writes counts the writes in progress, which the handler that made c
+	// waits for before it returns
+	writes sync.WaitGroup
+}
+
+func newH2Conn(w http.ResponseWriter, f http.Flusher, r *http.Request) *h2Conn {
+	return &h2Conn{
+		body:   r.Body,
+		w:      w,
+		f:      f,
+		remote: addr(r.RemoteAddr),
+		done:   make(chan struct{}),
+	}
+}
+
+func (c *h2Conn) Read(p []byte) (int, error) {
+	n, err := c.body.Read(p)
+	if err != nil && c.expired() {
+		err = timeoutError{}
+	}
+	return n, err
+}
+
+// Write doesn't hold c.mu while it writes, which may block on flow control
+// for as long as the peer doesn't read, so that Close doesn't wait for it.
+func (c *h2Conn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return 0, ErrConnectionClosed
+	}
+	c.writes.Add(1)
+	c.mu.Unlock()
+	defer c.writes.Done()
+
+	n, err := c.w.Write(p)
+	if err == nil {
+		c.f.Flush()
+	} else if c.expired() {
+		err = timeoutError{}
+	}
+	return n, err
+}
+
+// Close ends the request body, and lets the handler that made c return, which
+// ends the response, once the writes in progress are done.
+func (c *h2Conn) Close() error {
+	err := c.body.Close()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.closed {
+		c.closed = true
+		if c.timer != nil {
+			c.timer.Stop()
+		}
+		close(c.done)
+	}
+	return err
+}
+
+// wait waits for c to be closed and for its writes to be done, after which
+// the handler that made c may return.
+func (c *h2Conn) wait() {
+	<-c.done
+	c.writes.Wait()
+}
+
+func (c *h2Conn) LocalAddr() net.Addr  { return addr("local") }
+func (c *h2Conn) RemoteAddr() net.Addr { return c.remote }
+
+// SetDeadline can't interrupt the bodies and leave c usable, so c is closed
+// once the deadline passes, and the reads and writes it interrupts return a
+// timeout error.
+func (c *h2Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if !t.IsZero() && !c.closed {
+		c.timer = time.AfterFunc(time.Until(t), c.expire)
+	}
+	return nil
+}
+
+func (c *h2Conn) SetReadDeadline(t time.Time) error  { return c.SetDeadline(t) }
+func (c *h2Conn) SetWriteDeadline(t time.Time) error { return c.SetDeadline(t) }
+
+func (c *h2Conn) expire() {
+	c.mu.Lock()
+	c.timedOut = true
+	c.mu.Unlock()
+	c.Close()
+}
+
+func (c *h2Conn) expired() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.timedOut
+}
+
+// h2Body is the body of a Reverse HTTP response received over HTTP/2, which
+// writes to the body of its request. Closing it cancels the context of the
+// request.
+type h2Body struct {
+	io.ReadCloser
+	w      *io.PipeWriter
+	cancel func()
+}
+
+func (b h2Body) Write(p []byte) (int, error) {
+	return b.w.Write(p)
+}
+
+func (b h2Body) Close() error {
+	b.w.Close()
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
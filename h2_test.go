@@ -0,0 +1,172 @@
+package reversehttp
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type wrappedWriter struct {
+	http.ResponseWriter
+}
+
+func (w wrappedWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+type plainWriter struct {
+	http.ResponseWriter
+}
+
+func TestHijackerUnwrap(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w = wrappedWriter{wrappedWriter{w}}
+		expect(t, true, hijacker(w) != nil)
+		expect(t, true, flusher(w) != nil)
+		expect(t, true, hijacker(plainWriter{w}) == nil)
+
+		c, err := Upgrade(w, r)
+		expect(t, nil, err)
+		resp, err := c.Client().Get("http://ptth/")
+		expect(t, nil, err)
+		b, err := ioutil.ReadAll(resp.Body)
+		expect(t, nil, err)
+		expect(t, "wrapped", string(b))
+		c.Close()
+	}))
+	defer srv.Close()
+
+	d := &Dialer{Client: srv.Client()}
+	err := d.Reverse(context.Background(), srv.URL, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("wrapped"))
+	}))
+	expect(t, nil, err)
+}
+
+// stalledWriter is a response body that the peer stopped reading.
+type stalledWriter struct {
+	started, release chan struct{}
+}
+
+func (w stalledWriter) Write(p []byte) (int, error) {
+	close(w.started)
+	<-w.release
+	return len(p), nil
+}
+
+func TestH2ConnStalledWrite(t *testing.T) {
+	w := stalledWriter{make(chan struct{}), make(chan struct{})}
+	r := httptest.NewRequest("POST", "/", strings.NewReader(""))
+	c := newH2Conn(httptest.NewRecorder(), httptest.NewRecorder(), r)
+	c.w = w
+	go c.Write([]byte("hello"))
+	<-w.started
+
+	// closing is not held up by the write, but the handler still waits for
+	// it before returning
+	closed := make(chan struct{})
+	go func() {
+		c.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("close waited for a stalled write")
+	}
+	_, err := c.Write([]byte("hello"))
+	expect(t, ErrConnectionClosed, err)
+
+	waited := make(chan struct{})
+	go func() {
+		c.wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+		t.Error("handler returned during a write")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(w.release)
+	<-waited
+}
+
+func TestUpgradeHTTP2Unsupported(t *testing.T) {
+	r := httptest.NewRequest("POST", "/", nil)
+	r.ProtoMajor, r.ProtoMinor = 2, 0
+	r.Header.Set(HTTP2UpgradeHeader, "PTTH/1.0")
+	expect(t, true, IsReverseHTTPRequest(r))
+
+	_, err := Upgrade(plainWriter{httptest.NewRecorder()}, r)
+	expect(t, ErrHijackUnsupported, err)
+}
+
+func TestReverseHTTP2(t *testing.T) {
+	for _, multiplex := range []bool{false, true} {
+		hub := new(Hub)
+		connected := watchHub(hub)
+		srv := httptest.NewUnstartedServer(hub)
+		srv.EnableHTTP2 = true
+		srv.StartTLS()
+
+		// the handshake timeout does not outlive the handshake
+		d := &Dialer{
+			Client:           srv.Client(),
+			HTTP2:            true,
+			Multiplex:        multiplex,
+			HandshakeTimeout: 5 * time.Second,
+		}
+		_, done := connectHub(t, d, srv.URL, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("hello " + r.URL.Path[1:]))
+		}))
+
+		c := hub.Conn(<-connected)
+		expect(t, 2, c.Request().ProtoMajor)
+		for _, name := range []string{"one", "two"} {
+			resp, err := c.Client().Get("http://ptth/" + name)
+			expect(t, nil, err)
+			b, err := ioutil.ReadAll(resp.Body)
+			expect(t, nil, err)
+			expect(t, "hello "+name, string(b))
+			resp.Body.Close()
+		}
+
+		c.Close()
+		expect(t, nil, <-done)
+		srv.Close()
+	}
+}
+
+func TestHTTP2ResponseHeaderTimeout(t *testing.T) {
+	hub := &Hub{Upgrader: &Upgrader{ResponseHeaderTimeout: 50 * time.Millisecond}}
+	connected := watchHub(hub)
+	srv := httptest.NewUnstartedServer(hub)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	release := make(chan struct{})
+	d := &Dialer{Client: srv.Client(), HTTP2: true}
+	_, done := connectHub(t, d, srv.URL, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	c := hub.Conn(<-connected)
+
+	// the deadline closes the connection, as it can't interrupt the bodies
+	_, err := c.Client().Get("http://ptth/hang")
+	nerr, ok := err.(net.Error)
+	expect(t, true, ok && nerr.Timeout())
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second):
+		t.Error("connection was not closed after the timeout")
+	}
+
+	close(release)
+	<-done
+}
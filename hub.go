@@ -0,0 +1,231 @@
+package reversehttp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// ClientIDHeader is the header a reverse client can set on its upgrade
+// request to choose the ID it is registered under in a Hub. The Hub sends the
+// ID it used back in the same header of the upgrade response.
+const ClientIDHeader = "Ptth-Client-Id"
+
+// Hub is an http.Handler that accepts Reverse HTTP upgrades and keeps the
+// resulting connections in a registry, so that requests can be made to any
+// connected client by its ID. The zero value is an empty Hub ready to use.
+//
+// A client is removed from the Hub when its connection fails, when either side
+// asks for it to be closed, or when another client connects with the same ID.
+type Hub struct {
+	// Authenticator, if not nil, authenticates clients before their
+	// connections are upgraded. Clients are registered under the ID of their
+	// Identity, or, if it is empty, under the ID they asked for. It defaults
+	// to the Authenticator of the Upgrader.
+	Authenticator Authenticator
+
+	// Upgrader, if not nil, sets the timeouts of the clients' connections.
+	Upgrader *Upgrader
+
+	// ForwardListen, if not nil, opens a listener for every service a
+	// client declares with ForwardHeader, once it is connected. The
+	// connections accepted on it are forwarded to the service, as Forward
+	// does, and it is closed once the client disconnects. Only multiplexed
+	// connections get listeners, since a stream over any other connection
+	// takes the whole connection.
+	ForwardListen func(id, service string) (net.Listener, error)
+
+	// OnConnect, if not nil, is called after a client has been registered.
+	OnConnect func(id string)
+
+	// OnDisconnect, if not nil, is called after a client has been removed.
+	OnDisconnect func(id string)
+
+	mu      sync.Mutex
+	clients map[string]*ReverseConn
+}
+
+func (h *Hub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !IsReverseHTTPRequest(r) {
+		http.Error(w, "expected a reverse http upgrade", http.StatusBadRequest)
+		return
+	}
+
+	// the client is authenticated here rather than by the Upgrader, since
+	// its ID is needed before the upgrade
+	var u Upgrader
+	if h.Upgrader != nil {
+		u = *h.Upgrader
+	}
+	a := h.Authenticator
+	if a == nil {
+		a = u.Authenticator
+	}
+	u.Authenticator = nil
+
+	var identity Identity
+	if a != nil {
+		var err error
+		identity, err = Authenticate(w, r, a)
+		if err != nil {
+			return
+		}
+	}
+
+	id := identity.ID
+	if id == "" {
+		id = r.Header.Get(ClientIDHeader)
+	}
+	if id == "" {
+		id = newClientID()
+	}
+	identity.ID = id
+	w.Header().Set(ClientIDHeader, id)
+
+	c, err := u.Upgrade(w, r)
+	if err != nil {
+		w.Header().Del(ClientIDHeader)
+		upgradeError(w, r, &u, err)
+		return
+	}
+
+	// HTTP/2 connections end with this handler
+	c.identity = identity
+	h.openForwards(id, c)
+	h.add(c)
+	<-c.Done()
+	h.remove(id, c)
+	closeForwards(c)
+	c.Wait()
+}
+
+// upgradeError answers the request r, which u failed to upgrade with err.
+func upgradeError(w http.ResponseWriter, r *http.Request, u *Upgrader, err error) {
+	switch {
+	case errors.Is(err, ErrNotReverseRequest):
+		// the client offered none of the versions u accepts
+		upgrade := upgradeHeader(r.ProtoMajor)
+		for _, p := range u.supported() {
+			w.Header().Add(upgrade, p)
+		}
+		if r.ProtoMajor != 2 {
+			w.Header().Set("Connection", "Upgrade")
+		}
+		http.Error(w, err.Error(), http.StatusUpgradeRequired)
+	case errors.Is(err, errUpgradeBodyTooLarge):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	case errors.Is(err, ErrHijackUnsupported):
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+func (h *Hub) add(c *ReverseConn) {
+	id := c.identity.ID
+
+	h.mu.Lock()
+	if h.clients == nil {
+		h.clients = make(map[string]*ReverseConn)
+	}
+	old := h.clients[id]
+	h.clients[id] = c
+	h.mu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+
+	if h.OnConnect != nil {
+		h.OnConnect(id)
+	}
+}
+
+func (h *Hub) remove(id string, conn *ReverseConn) {
+	h.mu.Lock()
+	current := h.clients[id] == conn
+	if current {
+		delete(h.clients, id)
+	}
+	h.mu.Unlock()
+
+	if current && h.OnDisconnect != nil {
+		h.OnDisconnect(id)
+	}
+}
+
+// Conn returns the connection of the client connected with id, or nil if
+// there is no such client.
+func (h *Hub) Conn(id string) *ReverseConn {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	c := h.clients[id]
+	if c == nil {
+		return nil
+	}
+	return c
+}
+
+// Identity returns the identity of the client connected with id. Its Method
+// is empty if the Hub has no Authenticator.
+func (h *Hub) Identity(id string) (Identity, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	c := h.clients[id]
+	if c == nil {
+		return Identity{}, false
+	}
+	return c.identity, true
+}
+
+// Client returns an http.Client that makes requests to the client connected
+// with id, or nil if there is no such client. Requests made by any number of
+// Clients for the same id share one connection, and are sent one at a time
+// unless the connection is multiplexed.
+func (h *Hub) Client(id string) *http.Client {
+	c := h.Conn(id)
+	if c == nil {
+		return nil
+	}
+	return c.Client()
+}
+
+// Clients returns the IDs of the connected clients in sorted order.
+func (h *Hub) Clients() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ids := make([]string, 0, len(h.clients))
+	for id := range h.clients {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Close closes the connections of all connected clients.
+func (h *Hub) Close() error {
+	h.mu.Lock()
+	clients := make([]*ReverseConn, 0, len(h.clients))
+	for _, c := range h.clients {
+		clients = append(clients, c)
+	}
+	h.mu.Unlock()
+
+	for _, c := range clients {
+		c.Close()
+	}
+	return nil
+}
+
+func newClientID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
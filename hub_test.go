@@ -0,0 +1,214 @@
+package reversehttp
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// watchHub makes the OnConnect of hub send the ID of every client that
+// connects to the returned channel.
+func watchHub(hub *Hub) chan string {
+	connected := make(chan string, 10)
+	hub.OnConnect = func(id string) {
+		connected <- id
+	}
+	return connected
+}
+
+// connectHub connects a reverse client serving handler to the Hub at url,
+// upgrading with d. It returns the upgrade response and a channel receiving
+// the result of ReverseResponse.
+func connectHub(t *testing.T, d *Dialer, url string, handler http.Handler) (*http.Response, chan error) {
+	resp, err := d.Upgrade(context.Background(), url)
+	if !expect(t, nil, err) {
+		t.FailNow()
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		result <- ReverseResponse(resp, handler)
+	}()
+	return resp, result
+}
+
+func TestHub(t *testing.T) {
+	disconnected := make(chan string, 10)
+	hub := &Hub{
+		OnDisconnect: func(id string) {
+			disconnected <- id
+		},
+	}
+	connected := watchHub(hub)
+	srv := httptest.NewServer(hub)
+	defer srv.Close()
+
+	resp, err := srv.Client().Get(srv.URL)
+	expect(t, nil, err)
+	expect(t, http.StatusBadRequest, resp.StatusCode)
+
+	dialer := func(id string) *Dialer {
+		d := &Dialer{Client: srv.Client()}
+		if id != "" {
+			d.Header = http.Header{ClientIDHeader: {id}}
+		}
+		return d
+	}
+	handler := func(id string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(id + " " + r.URL.Path))
+		}
+	}
+
+	resp, aresult := connectHub(t, dialer("a"), srv.URL, handler("a"))
+	expect(t, "a", resp.Header.Get(ClientIDHeader))
+	expect(t, "a", <-connected)
+
+	resp, genresult := connectHub(t, dialer(""), srv.URL, handler("gen"))
+	gen := resp.Header.Get(ClientIDHeader)
+	if gen == "" {
+		t.Error("hub did not assign an id")
+	}
+	expect(t, gen, <-connected)
+
+	expected := []string{"a", gen}
+	if gen < "a" {
+		expected = []string{gen, "a"}
+	}
+	expect(t, expected, hub.Clients())
+
+	if hub.Client("missing") != nil {
+		t.Error("got a client for an unknown id")
+	}
+	expect(t, "a", hub.Conn("a").Request().Header.Get(ClientIDHeader))
+
+	for _, ids := range [][2]string{{"a", "a"}, {gen, "gen"}, {"a", "a"}} {
+		resp, err := hub.Client(ids[0]).Get("http://example.com/hello")
+		if !expect(t, nil, err) {
+			continue
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		expect(t, nil, err)
+		expect(t, ids[1]+" /hello", string(b))
+	}
+
+	// a client that closes the connection is removed
+	req, err := http.NewRequest("GET", "http://example.com/bye", nil)
+	expect(t, nil, err)
+	req.Close = true
+	resp, err = hub.Client("a").Do(req)
+	expect(t, nil, err)
+	resp.Body.Close()
+	expect(t, nil, <-aresult)
+	expect(t, "a", <-disconnected)
+	expect(t, []string{gen}, hub.Clients())
+
+	// reconnecting with the same id replaces the old connection
+	_, bresult := connectHub(t, dialer("b"), srv.URL, handler("b1"))
+	expect(t, "b", <-connected)
+	_, b2result := connectHub(t, dialer("b"), srv.URL, handler("b2"))
+	expect(t, "b", <-connected)
+	if <-bresult == nil {
+		t.Error("replaced connection did not fail")
+	}
+
+	resp, err = hub.Client("b").Get("http://example.com/")
+	expect(t, nil, err)
+	b, err := ioutil.ReadAll(resp.Body)
+	expect(t, nil, err)
+	expect(t, "b2 /", string(b))
+
+	hub.Close()
+	<-genresult
+	<-b2result
+	for i := 0; i < 2; i++ {
+		<-disconnected
+	}
+	expect(t, []string{}, hub.Clients())
+}
+
+func TestHubUpgradeErrors(t *testing.T) {
+	hub := &Hub{Upgrader: &Upgrader{Protocols: []string{PTTH11}}}
+	srv := httptest.NewServer(hub)
+	defer srv.Close()
+
+	// a version the hub does not accept
+	req, err := NewRequest(srv.URL)
+	expect(t, nil, err)
+	req.Header.Set("Upgrade", PTTH10)
+	resp, err := srv.Client().Do(req)
+	if expect(t, nil, err) {
+		expect(t, http.StatusUpgradeRequired, resp.StatusCode)
+		expect(t, PTTH11, resp.Header.Get("Upgrade"))
+		expect(t, "", resp.Header.Get(ClientIDHeader))
+		resp.Body.Close()
+	}
+
+	// a body that is too large to discard
+	req, err = NewUpgradeRequest("POST", srv.URL,
+		bytes.NewReader(make([]byte, maxUpgradeBody+1)))
+	expect(t, nil, err)
+	resp, err = srv.Client().Do(req)
+	if expect(t, nil, err) {
+		expect(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+		resp.Body.Close()
+	}
+}
+
+func TestHubHeartbeat(t *testing.T) {
+	disconnected := make(chan string, 10)
+	hub := &Hub{
+		Upgrader: &Upgrader{
+			HeartbeatInterval: 20 * time.Millisecond,
+			HeartbeatMisses:   2,
+		},
+		OnDisconnect: func(id string) {
+			disconnected <- id
+		},
+	}
+	connected := watchHub(hub)
+	srv := httptest.NewServer(hub)
+	defer srv.Close()
+	defer hub.Close()
+
+	// a client that answers stays connected, without its handler being
+	// called for the heartbeats
+	for _, multiplex := range []bool{false, true} {
+		d := &Dialer{
+			Client:    srv.Client(),
+			Header:    http.Header{ClientIDHeader: {"alive"}},
+			Multiplex: multiplex,
+		}
+		connectHub(t, d, srv.URL, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Error("handler called for a heartbeat")
+		}))
+		expect(t, "alive", <-connected)
+		time.Sleep(200 * time.Millisecond)
+		expect(t, []string{"alive"}, hub.Clients())
+		hub.Close()
+		expect(t, "alive", <-disconnected)
+	}
+
+	// a client that stops answering is removed
+	d := &Dialer{
+		Client: srv.Client(),
+		Header: http.Header{ClientIDHeader: {"dead"}},
+	}
+	resp, err := d.Upgrade(context.Background(), srv.URL)
+	if !expect(t, nil, err) {
+		return
+	}
+	defer resp.Body.Close()
+	expect(t, "dead", <-connected)
+	select {
+	case id := <-disconnected:
+		expect(t, "dead", id)
+	case <-time.After(time.Second):
+		t.Error("dead client was not removed")
+	}
+	expect(t, []string{}, hub.Clients())
+}
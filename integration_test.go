@@ -1,10 +1,14 @@
 package reversehttp
 
 import (
+	"bufio"
+	"context"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 func TestReverseHTTPGet(t *testing.T) {
@@ -13,7 +17,10 @@ func TestReverseHTTPGet(t *testing.T) {
 	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		c, err := ReverseRequest(w, r)
 		expect(t, nil, err)
-		resp, err := c.Get("http://example.com/path2")
+		req, err := http.NewRequest("GET", "http://example.com/path2", nil)
+		expect(t, nil, err)
+		req.Close = true
+		resp, err := c.Do(req)
 		expect(t, nil, err)
 
 		b, err := ioutil.ReadAll(resp.Body)
@@ -24,13 +31,12 @@ func TestReverseHTTPGet(t *testing.T) {
 	}))
 	defer srv.Close()
 
-	http.DefaultClient = srv.Client()
-
-	err := ReverseFunc(srv.URL, func(w http.ResponseWriter, r *http.Request) {
+	d := &Dialer{Client: srv.Client()}
+	err := d.Reverse(context.Background(), srv.URL, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Content-Type", "text/plan")
 		_, err := w.Write([]byte("hello world\n"))
 		expect(t, nil, err)
-	})
+	}))
 	expect(t, nil, err)
 	<-endserver
 }
@@ -41,26 +47,27 @@ func TestReverseReverseHTTP(t *testing.T) {
 	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		c, err := ReverseRequest(w, r)
 		expect(t, nil, err)
-		http.DefaultClient = c
-
-		err = ReverseFunc("http://whatever.co.uk/blah", func(w http.ResponseWriter, r *http.Request) {
+		d := &Dialer{Client: c}
+		err = d.Reverse(context.Background(), "http://whatever.co.uk/blah", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			w.Header().Add("Content-Type", "text/plan")
 			_, err := w.Write([]byte("hello world\n"))
 			expect(t, nil, err)
-		})
+		}))
 		expect(t, nil, err)
 
 		close(endserver)
 	}))
 	defer srv.Close()
 
-	http.DefaultClient = srv.Client()
-
 	endclient := make(chan struct{})
-	err := ReverseFunc(srv.URL, func(w http.ResponseWriter, r *http.Request) {
+	d := &Dialer{Client: srv.Client()}
+	err := d.Reverse(context.Background(), srv.URL, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		c, err := ReverseRequest(w, r)
 		expect(t, nil, err)
-		resp, err := c.Get("http://example.com/path2")
+		req, err := http.NewRequest("GET", "http://example.com/path2", nil)
+		expect(t, nil, err)
+		req.Close = true
+		resp, err := c.Do(req)
 		expect(t, nil, err)
 
 		b, err := ioutil.ReadAll(resp.Body)
@@ -68,8 +75,141 @@ func TestReverseReverseHTTP(t *testing.T) {
 		expect(t, []byte("hello world\n"), b)
 		resp.Body.Close()
 		close(endclient)
-	})
+	}))
 	expect(t, nil, err)
 	<-endclient
 	<-endserver
 }
+
+func TestReverseHTTPPersistent(t *testing.T) {
+	endserver := make(chan struct{})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := ReverseRequest(w, r)
+		expect(t, nil, err)
+
+		for i := 0; i < 10; i++ {
+			req, err := http.NewRequest("GET", "http://example.com/path2", nil)
+			expect(t, nil, err)
+			req.Close = i == 9
+			resp, err := c.Do(req)
+			if !expect(t, nil, err) {
+				break
+			}
+
+			// unread bodies are skipped by the next request
+			if i%2 == 0 {
+				b, err := ioutil.ReadAll(resp.Body)
+				expect(t, nil, err)
+				expect(t, []byte("hello world\n"), b)
+				resp.Body.Close()
+			}
+		}
+
+		_, err = c.Get("http://example.com/path2")
+		if err == nil {
+			t.Error("request on a closed connection did not fail")
+		}
+
+		close(endserver)
+	}))
+	defer srv.Close()
+
+	served := 0
+	d := &Dialer{Client: srv.Client()}
+	err := d.Reverse(context.Background(), srv.URL, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served++
+		w.Header().Add("Content-Type", "text/plain")
+		_, err := w.Write([]byte("hello world\n"))
+		expect(t, nil, err)
+	}))
+	expect(t, nil, err)
+	expect(t, 10, served)
+	<-endserver
+}
+
+func TestReverseHTTPStream(t *testing.T) {
+	endserver := make(chan struct{})
+	next := make(chan struct{})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := ReverseRequest(w, r)
+		expect(t, nil, err)
+		req, err := http.NewRequest("GET", "http://example.com/events", nil)
+		expect(t, nil, err)
+		req.Close = true
+		resp, err := c.Do(req)
+		if !expect(t, nil, err) {
+			close(endserver)
+			return
+		}
+
+		// every event arrives before the handler writes the next one
+		br := bufio.NewReader(resp.Body)
+		for i := 0; i < 3; i++ {
+			line, err := br.ReadString('\n')
+			expect(t, nil, err)
+			expect(t, fmt.Sprintf("data: %d\n", i), line)
+			br.ReadString('\n')
+			next <- struct{}{}
+		}
+		resp.Body.Close()
+
+		close(endserver)
+	}))
+	defer srv.Close()
+
+	d := &Dialer{Client: srv.Client()}
+	err := d.Reverse(context.Background(), srv.URL, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 3; i++ {
+			fmt.Fprintf(w, "data: %d\n\n", i)
+			w.(http.Flusher).Flush()
+			<-next
+		}
+	}))
+	expect(t, nil, err)
+	<-endserver
+}
+
+func TestReverseHTTPHijack(t *testing.T) {
+	endserver := make(chan struct{})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := ReverseRequest(w, r)
+		expect(t, nil, err)
+		req, err := http.NewRequest("GET", "http://example.com/path2", nil)
+		expect(t, nil, err)
+		resp, err := c.Do(req)
+		if expect(t, nil, err) {
+			b, err := ioutil.ReadAll(resp.Body)
+			expect(t, nil, err)
+			expect(t, []byte("hello world\n"), b)
+		}
+
+		close(endserver)
+	}))
+	defer srv.Close()
+
+	// the hijacked connection outlives the call to Reverse
+	returned := make(chan struct{})
+	d := &Dialer{Client: srv.Client()}
+	err := d.Reverse(context.Background(), srv.URL, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if !expect(t, nil, err) {
+			return
+		}
+		expect(t, srv.Listener.Addr().String(), conn.RemoteAddr().String())
+		expect(t, nil, conn.SetDeadline(time.Now().Add(time.Minute)))
+
+		go func() {
+			<-returned
+			rw.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 12\r\nConnection: close\r\n\r\nhello world\n")
+			rw.Flush()
+			conn.Close()
+		}()
+	}))
+	expect(t, nil, err)
+	close(returned)
+	<-endserver
+}
@@ -0,0 +1,231 @@
+package reversehttp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fixture reads a synthetic upgrade request or response from testdata, see
+// testdata/README.
+func fixture(t *testing.T, name string) []byte {
+	b, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Replace(b, []byte("\n"), []byte("\r\n"), -1)
+}
+
+func TestSyntheticRequests(t *testing.T) {
+	for _, name := range []string{"event", "get", "post-body", "post-chunked"} {
+		conns := make(chan *ReverseConn, 1)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c, err := Upgrade(w, r)
+			if !expect(t, nil, err) {
+				return
+			}
+			conns <- c
+		}))
+
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if !expect(t, nil, err) {
+			srv.Close()
+			continue
+		}
+		conn.Write(fixture(t, name+".request"))
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, nil)
+		if expect(t, nil, err) {
+			expect(t, http.StatusSwitchingProtocols, resp.StatusCode)
+			expect(t, PTTH10, ResponseProtocol(resp))
+		}
+
+		// the body of the upgrade request does not get in the way of the
+		// first response
+		c := <-conns
+		expect(t, PTTH10, c.Protocol())
+		go func() {
+			req, err := http.ReadRequest(br)
+			if expect(t, nil, err) {
+				expect(t, "/hello", req.URL.Path)
+			}
+			conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello"))
+		}()
+		resp, err = c.Client().Get("http://ptth/hello")
+		if expect(t, nil, err) {
+			b, err := ioutil.ReadAll(resp.Body)
+			expect(t, nil, err)
+			expect(t, "hello", string(b))
+		}
+
+		c.Close()
+		conn.Close()
+		srv.Close()
+	}
+}
+
+func TestSyntheticResponses(t *testing.T) {
+	for _, name := range []string{"event", "lowercase"} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			expect(t, "GET", r.Method)
+			conn, br, err := w.(http.Hijacker).Hijack()
+			if !expect(t, nil, err) {
+				return
+			}
+			defer conn.Close()
+			conn.Write(fixture(t, name+".response"))
+
+			conn.Write([]byte("GET /hello HTTP/1.1\r\nHost: ptth\r\n\r\n"))
+			resp, err := http.ReadResponse(br.Reader, nil)
+			if expect(t, nil, err) {
+				b, err := ioutil.ReadAll(resp.Body)
+				expect(t, nil, err)
+				expect(t, "hello", string(b))
+			}
+		}))
+
+		d := &Dialer{Client: srv.Client(), Method: "GET"}
+		err := d.Reverse(context.Background(), srv.URL, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(strings.TrimPrefix(r.URL.Path, "/")))
+		}))
+		expect(t, nil, err)
+		srv.Close()
+	}
+}
+
+func TestUpgradeBody(t *testing.T) {
+	for _, method := range []string{"GET", "POST"} {
+		bodies := make(chan string, 1)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			expect(t, method, r.Method)
+			// part of the body is read, and the rest is discarded
+			b := make([]byte, 6)
+			_, err := r.Body.Read(b)
+			expect(t, nil, err)
+			bodies <- string(b)
+
+			c, err := Upgrade(w, r)
+			if !expect(t, nil, err) {
+				return
+			}
+			defer c.Close()
+			resp, err := c.Client().Get("http://ptth/")
+			if expect(t, nil, err) {
+				b, err := ioutil.ReadAll(resp.Body)
+				expect(t, nil, err)
+				expect(t, "hello", string(b))
+			}
+		}))
+
+		d := &Dialer{
+			Client: srv.Client(),
+			Method: method,
+			Body:   []byte("sensor-7 is online"),
+		}
+		err := d.Reverse(context.Background(), srv.URL, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("hello"))
+		}))
+		expect(t, nil, err)
+		expect(t, "sensor", <-bodies)
+		srv.Close()
+	}
+}
+
+func TestUpgradeBodyTooLarge(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := Upgrade(w, r)
+		expect(t, errUpgradeBodyTooLarge, err)
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	}))
+	defer srv.Close()
+
+	d := &Dialer{Client: srv.Client(), Body: make([]byte, maxUpgradeBody+1)}
+	_, err := d.Upgrade(context.Background(), srv.URL)
+	var rejected *UpgradeRejectedError
+	if expect(t, true, errors.As(err, &rejected)) {
+		expect(t, http.StatusRequestEntityTooLarge, rejected.StatusCode)
+	}
+
+	d = &Dialer{Client: srv.Client(), Body: []byte("body"), HTTP2: true}
+	_, err = d.Upgrade(context.Background(), srv.URL)
+	expect(t, errHTTP2Body, err)
+}
+
+// strictUpgrade upgrades r as servers that only support PTTH/1.0 do, by
+// comparing whole header values, and then checks that the client serves a
+// request. The body of r is discarded and returned.
+func strictUpgrade(t *testing.T, w http.ResponseWriter, r *http.Request) string {
+	if r.Header.Get("Upgrade") != "PTTH/1.0" ||
+		r.Header.Get("Connection") != "Upgrade" {
+		http.Error(w, "not a reverse http request", http.StatusBadRequest)
+		return ""
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	expect(t, nil, err)
+	conn, br, err := w.(http.Hijacker).Hijack()
+	if !expect(t, nil, err) {
+		return ""
+	}
+	defer conn.Close()
+	conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: PTTH/1.0\r\nConnection: Upgrade\r\n\r\n"))
+
+	conn.Write([]byte("GET /hello HTTP/1.1\r\nHost: ptth\r\n\r\n"))
+	resp, err := http.ReadResponse(br.Reader, nil)
+	if expect(t, nil, err) {
+		b, err := ioutil.ReadAll(resp.Body)
+		expect(t, nil, err)
+		expect(t, "hello", string(b))
+	}
+	return string(body)
+}
+
+func TestStrictServer(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		strictUpgrade(t, w, r)
+	}))
+	defer srv.Close()
+
+	req, err := NewRequest(srv.URL)
+	if !expect(t, nil, err) {
+		return
+	}
+	resp, err := srv.Client().Do(req)
+	if !expect(t, nil, err) {
+		return
+	}
+	expect(t, PTTH10, ResponseProtocol(resp))
+	err = ReverseResponse(resp, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	expect(t, nil, err)
+}
+
+func TestStrictServerDialer(t *testing.T) {
+	// the Dialer offers PTTH/1.0 first too, whatever the method and body of
+	// its upgrade request
+	bodies := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		expect(t, "GET", r.Method)
+		bodies <- strictUpgrade(t, w, r)
+	}))
+	defer srv.Close()
+
+	d := &Dialer{
+		Client: srv.Client(),
+		Method: "GET",
+		Body:   []byte("sensor-7 is online"),
+	}
+	err := d.Reverse(context.Background(), srv.URL, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	expect(t, nil, err)
+	expect(t, "sensor-7 is online", <-bodies)
+}
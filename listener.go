@@ -0,0 +1,163 @@
+package reversehttp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// errListenerClosed is returned by Accept once the Listener is closed.
+var errListenerClosed = errors.New("reverse http listener is closed")
+
+// ListenOptions configures the Listener returned by Listen.
+type ListenOptions struct {
+	// Dialer makes the upgrade requests. If nil, the zero Dialer is used. It
+	// must not offer MuxProtocol.
+	Dialer *Dialer
+
+	// Conns is the number of upgraded connections the Listener keeps open. A
+	// new upgrade request is made whenever one of them is closed. It
+	// defaults to 1. A Hub replaces the connection of a client that connects
+	// again with the same ID, so against a Hub, more than one connection
+	// needs the Dialer to leave ClientIDHeader unset, or to set a different
+	// one on each request with Prepare.
+	Conns int
+
+	// MinBackoff and MaxBackoff bound the delay between failed upgrade
+	// requests, as they do for an Agent.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// OnError, if not nil, is called with the error of every failed upgrade
+	// request.
+	OnError func(err error)
+}
+
+// Listen returns a net.Listener whose connections are Reverse HTTP
+// connections upgraded by requests to url, made as configured by opts, which
+// may be nil. The server's requests can then be served by an http.Server,
+// with all of its features, instead of by ReverseResponse:
+//
+//	l, _ := reversehttp.Listen("http://example.com/ptth", nil)
+//	http.Serve(l, handler)
+//
+// Closing the Listener stops it from making upgrade requests, connections
+// already accepted are left open.
+func Listen(url string, opts *ListenOptions) (net.Listener, error) {
+	if opts == nil {
+		opts = new(ListenOptions)
+	}
+	if opts.Dialer != nil && opts.Dialer.Multiplex {
+		return nil, errors.New("a reverse http listener can't multiplex connections")
+	}
+	if _, err := http.NewRequest("POST", url, nil); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	l := &listener{
+		url:    url,
+		opts:   opts,
+		conns:  make(chan net.Conn),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	n := opts.Conns
+	if n <= 0 {
+		n = 1
+	}
+	for i := 0; i < n; i++ {
+		go l.keep()
+	}
+	return l, nil
+}
+
+type listener struct {
+	url   string
+	opts  *ListenOptions
+	conns chan net.Conn
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// keep keeps one upgraded connection open until the listener is closed.
+func (l *listener) keep() {
+	b := newBackoff(l.opts.MinBackoff, l.opts.MaxBackoff)
+	for {
+		resp, retryAfter, err := connect(l.ctx, l.opts.Dialer, l.url)
+		if l.ctx.Err() != nil {
+			if err == nil {
+				resp.Body.Close()
+			}
+			return
+		}
+
+		if err != nil {
+			if l.opts.OnError != nil {
+				l.opts.OnError(err)
+			}
+			if !b.wait(l.ctx, retryAfter) {
+				return
+			}
+			continue
+		}
+		b.reset()
+
+		c := &listenerConn{
+			bodyConn: newBodyConn(resp.Body.(io.ReadWriteCloser)),
+			closed:   make(chan struct{}),
+		}
+		select {
+		case l.conns <- c:
+		case <-l.ctx.Done():
+			c.Close()
+			return
+		}
+
+		select {
+		case <-c.closed:
+		case <-l.ctx.Done():
+			return
+		}
+	}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.ctx.Done():
+		return nil, errListenerClosed
+	}
+}
+
+func (l *listener) Close() error {
+	l.cancel()
+	return nil
+}
+
+func (l *listener) Addr() net.Addr {
+	return addr(l.url)
+}
+
+// listenerConn is a connection accepted from a listener, which makes a new
+// upgrade request once it is closed.
+type listenerConn struct {
+	*bodyConn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (c *listenerConn) Close() error {
+	err := c.bodyConn.Close()
+	c.once.Do(func() {
+		close(c.closed)
+	})
+	return err
+}
@@ -0,0 +1,87 @@
+package reversehttp
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestListen(t *testing.T) {
+	hub := new(Hub)
+	connected := watchHub(hub)
+
+	// the hub closes the connection a client replaces, so reconnecting
+	// waits for the test to finish with the old one
+	reconnect := make(chan struct{})
+	var upgrades int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&upgrades, 1) > 1 {
+			<-reconnect
+		}
+		hub.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	defer hub.Close()
+
+	_, err := Listen(srv.URL, &ListenOptions{Dialer: &Dialer{Multiplex: true}})
+	if err == nil {
+		t.Error("listener accepted a multiplexing dialer")
+	}
+
+	l, err := Listen(srv.URL, &ListenOptions{
+		Dialer: &Dialer{
+			Client: srv.Client(),
+			Header: http.Header{ClientIDHeader: {"agent"}},
+		},
+	})
+	if !expect(t, nil, err) {
+		return
+	}
+	expect(t, "ptth", l.Addr().Network())
+	expect(t, srv.URL, l.Addr().String())
+
+	agent := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("hello " + r.URL.Path))
+		}),
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- agent.Serve(l)
+	}()
+	expect(t, "agent", <-connected)
+
+	get := func(close bool) {
+		req, err := http.NewRequest("GET", "http://agent/world", nil)
+		expect(t, nil, err)
+		req.Close = close
+		resp, err := hub.Client("agent").Do(req)
+		if !expect(t, nil, err) {
+			return
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		expect(t, nil, err)
+		expect(t, "hello /world", string(b))
+		resp.Body.Close()
+	}
+
+	// requests are served by the http.Server, which keeps the connection
+	// open between them
+	for i := 0; i < 3; i++ {
+		get(false)
+	}
+
+	// a closed connection is replaced
+	get(true)
+	close(reconnect)
+	expect(t, "agent", <-connected)
+	get(false)
+
+	expect(t, nil, agent.Shutdown(context.Background()))
+	expect(t, http.ErrServerClosed, <-served)
+	_, err = l.Accept()
+	expect(t, errListenerClosed, err)
+}
@@ -0,0 +1,725 @@
+package reversehttp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// MuxProtocol is the Upgrade token an agent adds to its upgrade request to
+// offer multiplexing, and that the server echoes when it accepts. On a
+// multiplexed connection, every request is made on its own stream, so the
+// server can make any number of requests concurrently and the agent serves
+// them in parallel.
+//
+// Streams are carried in frames made of a 9 byte header, holding the frame
+// type, the stream ID and the length of the payload, followed by the payload.
+// Each stream has its own flow control window, which the receiver extends as
+// the data is consumed.
+const MuxProtocol = "PTTH-MUX/1.0"
+
+const (
+	frameOpen = iota
+	frameData
+	frameWindow
+	frameClose
+	frameReset
+)
+
+const (
+	frameHeaderSize = 9
+	maxFramePayload = 16 << 10
+	streamWindow    = 256 << 10
+	acceptBacklog   = 256
+
+	// writeErrorGrace is how long a session outlives a failed write, for
+	// its read loop to see how the peer finished.
+	writeErrorGrace = time.Second
+)
+
+var (
+	errSessionClosed = errors.New("multiplexed connection is closed")
+	errStreamClosed  = errors.New("stream is closed")
+	errStreamReset   = errors.New("stream was reset by the peer")
+	errProtocol      = errors.New("multiplexing protocol error")
+)
+
+// timeoutError is returned by streams when a deadline is exceeded.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// addr is the net.Addr of a reverse http connection whose network address is
+// unknown.
+type addr string
+
+func (a addr) Network() string { return "ptth" }
+func (a addr) String() string  { return string(a) }
+
+// session multiplexes streams over one upgraded connection.
+type session struct {
+	br     *bufio.Reader
+	closer io.Closer
+	conn   net.Conn
+
+	wmu  sync.Mutex
+	bw   *bufio.Writer
+	werr error
+
+	mu      sync.Mutex
+	streams map[uint32]*stream
+	nextID  uint32
+	err     error
+
+	// server is set on the server side, which opens streams but does not
+	// accept them, so accepts is nil
+	server  bool
+	accepts chan *stream
+	done    chan struct{}
+}
+
+// newSession starts a session reading frames from br and writing them to bw.
+// Closing the session closes c. conn, if not nil, provides the addresses of
+// the streams. The server opens streams with odd IDs, the agent with even
+// ones. Only the agent accepts streams: those the agent opens are reset by the
+// server.
+func newSession(br *bufio.Reader, bw *bufio.Writer, c io.Closer, conn net.Conn, server bool) *session {
+	sess := &session{
+		br:      br,
+		closer:  c,
+		conn:    conn,
+		bw:      bw,
+		streams: make(map[uint32]*stream),
+		nextID:  2,
+		server:  server,
+		done:    make(chan struct{}),
+	}
+	if server {
+		sess.nextID = 1
+	} else {
+		sess.accepts = make(chan *stream, acceptBacklog)
+	}
+	go sess.readLoop()
+	return sess
+}
+
+func (sess *session) writeFrame(typ byte, id uint32, payload []byte) error {
+	var hdr [frameHeaderSize]byte
+	hdr[0] = typ
+	binary.BigEndian.PutUint32(hdr[1:5], id)
+	binary.BigEndian.PutUint32(hdr[5:9], uint32(len(payload)))
+
+	sess.wmu.Lock()
+	defer sess.wmu.Unlock()
+
+	if err := sess.closedErr(); err != nil {
+		return err
+	} else if sess.werr != nil {
+		return sess.werr
+	}
+
+	sess.bw.Write(hdr[:])
+	sess.bw.Write(payload)
+	if err := sess.bw.Flush(); err != nil {
+		sess.werr = err
+		go sess.writeFailed(err)
+		return err
+	}
+	return nil
+}
+
+// writeFailed closes the session after a write failed with err. A peer that
+// has finished with the connection can make writes fail before the read loop
+// sees io.EOF, so the read loop is given writeErrorGrace to end the session
+// with that instead.
+func (sess *session) writeFailed(err error) {
+	timer := time.NewTimer(writeErrorGrace)
+	defer timer.Stop()
+
+	select {
+	case <-sess.done:
+	case <-timer.C:
+		sess.closeWithError(err)
+	}
+}
+
+func (sess *session) closedErr() error {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	return sess.err
+}
+
+func (sess *session) readLoop() {
+	var hdr [frameHeaderSize]byte
+	for {
+		if _, err := io.ReadFull(sess.br, hdr[:]); err != nil {
+			sess.closeWithError(err)
+			return
+		}
+
+		typ := hdr[0]
+		id := binary.BigEndian.Uint32(hdr[1:5])
+		length := binary.BigEndian.Uint32(hdr[5:9])
+		if length > maxFramePayload {
+			sess.closeWithError(errProtocol)
+			return
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(sess.br, payload); err != nil {
+			sess.closeWithError(err)
+			return
+		}
+
+		if err := sess.handleFrame(typ, id, payload); err != nil {
+			sess.closeWithError(err)
+			return
+		}
+	}
+}
+
+func (sess *session) handleFrame(typ byte, id uint32, payload []byte) error {
+	sess.mu.Lock()
+	s := sess.streams[id]
+	if typ == frameOpen {
+		// the peer opens streams with its own parity, odd for the server
+		if s != nil || id == 0 || (id%2 == 1) == sess.server {
+			sess.mu.Unlock()
+			return errProtocol
+		}
+		if sess.accepts == nil {
+			sess.mu.Unlock()
+			return sess.writeFrame(frameReset, id, nil)
+		}
+		s = newStream(sess, id)
+		sess.streams[id] = s
+	}
+	sess.mu.Unlock()
+
+	if typ == frameOpen {
+		select {
+		case sess.accepts <- s:
+		default:
+			// nobody is accepting streams
+			s.Close()
+		}
+		return nil
+	}
+
+	// frames for streams that have been closed on this side are dropped
+	if s == nil {
+		return nil
+	}
+
+	switch typ {
+	case frameData:
+		if !s.receive(payload) {
+			s.Close()
+		}
+	case frameWindow:
+		if len(payload) != 4 {
+			return errProtocol
+		}
+		s.extendWindow(binary.BigEndian.Uint32(payload))
+	case frameClose:
+		s.remoteClose()
+	case frameReset:
+		s.remoteReset()
+	default:
+		return errProtocol
+	}
+	return nil
+}
+
+// open opens a new stream to the peer.
+func (sess *session) open() (*stream, error) {
+	sess.mu.Lock()
+	if sess.err != nil {
+		sess.mu.Unlock()
+		return nil, sess.err
+	}
+	id := sess.nextID
+	sess.nextID += 2
+	s := newStream(sess, id)
+	sess.streams[id] = s
+	sess.mu.Unlock()
+
+	if err := sess.writeFrame(frameOpen, id, nil); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// accept waits for the peer to open a stream.
+func (sess *session) accept() (*stream, error) {
+	select {
+	case s := <-sess.accepts:
+		return s, nil
+	case <-sess.done:
+		return nil, sess.closedErr()
+	}
+}
+
+func (sess *session) remove(id uint32) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	delete(sess.streams, id)
+}
+
+func (sess *session) closeWithError(err error) {
+	sess.mu.Lock()
+	if sess.err != nil {
+		sess.mu.Unlock()
+		return
+	}
+	sess.err = err
+	streams := sess.streams
+	sess.streams = make(map[uint32]*stream)
+	sess.mu.Unlock()
+
+	sess.closer.Close()
+	for _, s := range streams {
+		s.sessionClosed()
+	}
+	close(sess.done)
+}
+
+// Close closes the session and all of its streams.
+func (sess *session) Close() error {
+	sess.closeWithError(errSessionClosed)
+	return nil
+}
+
+func (sess *session) localAddr() net.Addr {
+	if sess.conn != nil {
+		return sess.conn.LocalAddr()
+	}
+	return addr("local")
+}
+
+func (sess *session) remoteAddr() net.Addr {
+	if sess.conn != nil {
+		return sess.conn.RemoteAddr()
+	}
+	return addr("remote")
+}
+
+// stream is one bidirectional stream of a session. It implements net.Conn.
+type stream struct {
+	id   uint32
+	sess *session
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	buf  bytes.Buffer
+
+	recvWindow uint32
+	consumed   uint32
+	sendWindow uint32
+
+	closed       bool // Close was called
+	writeClosed  bool // no more data will be sent
+	remoteClosed bool // no more data will be received
+	err          error
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readTimer     *time.Timer
+	writeTimer    *time.Timer
+}
+
+func newStream(sess *session, id uint32) *stream {
+	s := &stream{
+		id:         id,
+		sess:       sess,
+		recvWindow: streamWindow,
+		sendWindow: streamWindow,
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// receive queues data from the peer, it returns false if the peer exceeded
+// the window.
+func (s *stream) receive(p []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if uint32(len(p)) > s.recvWindow {
+		return false
+	}
+	s.recvWindow -= uint32(len(p))
+	if !s.closed {
+		s.buf.Write(p)
+		s.cond.Broadcast()
+	}
+	return true
+}
+
+func (s *stream) extendWindow(n uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sendWindow += n
+	s.cond.Broadcast()
+}
+
+func (s *stream) remoteClose() {
+	s.mu.Lock()
+	s.remoteClosed = true
+	done := s.writeClosed
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	if done {
+		s.sess.remove(s.id)
+	}
+}
+
+func (s *stream) remoteReset() {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = errStreamReset
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	s.sess.remove(s.id)
+}
+
+func (s *stream) sessionClosed() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err == nil {
+		s.err = errSessionClosed
+	}
+	s.cond.Broadcast()
+}
+
+func expired(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
+
+func (s *stream) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	for s.buf.Len() == 0 {
+		switch {
+		case s.closed:
+			s.mu.Unlock()
+			return 0, errStreamClosed
+		case s.remoteClosed:
+			s.mu.Unlock()
+			return 0, io.EOF
+		case s.err != nil:
+			err := s.err
+			s.mu.Unlock()
+			return 0, err
+		case expired(s.readDeadline):
+			s.mu.Unlock()
+			return 0, timeoutError{}
+		}
+		s.cond.Wait()
+	}
+
+	n, _ := s.buf.Read(p)
+	s.consumed += uint32(n)
+	var update uint32
+	if s.consumed >= streamWindow/2 {
+		update = s.consumed
+		s.recvWindow += update
+		s.consumed = 0
+	}
+	s.mu.Unlock()
+
+	if update > 0 {
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], update)
+		s.sess.writeFrame(frameWindow, s.id, b[:])
+	}
+	return n, nil
+}
+
+func (s *stream) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		s.mu.Lock()
+		for s.sendWindow == 0 || s.err != nil || s.closed ||
+			s.writeClosed || expired(s.writeDeadline) {
+
+			switch {
+			case s.closed || s.writeClosed:
+				s.mu.Unlock()
+				return written, errStreamClosed
+			case s.err != nil:
+				err := s.err
+				s.mu.Unlock()
+				return written, err
+			case expired(s.writeDeadline):
+				s.mu.Unlock()
+				return written, timeoutError{}
+			}
+			s.cond.Wait()
+		}
+
+		n := len(p) - written
+		if n > maxFramePayload {
+			n = maxFramePayload
+		}
+		if uint32(n) > s.sendWindow {
+			n = int(s.sendWindow)
+		}
+		s.sendWindow -= uint32(n)
+		s.mu.Unlock()
+
+		if err := s.sess.writeFrame(frameData, s.id, p[written:written+n]); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// CloseWrite tells the peer that no more data will be written to the stream.
+func (s *stream) CloseWrite() error {
+	s.mu.Lock()
+	if s.writeClosed || s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.writeClosed = true
+	done := s.remoteClosed
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	if done {
+		s.sess.remove(s.id)
+	}
+	return s.sess.writeFrame(frameClose, s.id, nil)
+}
+
+// Close closes the stream. If the peer may still send data, the stream is
+// reset so that the peer stops.
+func (s *stream) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	writeClosed := s.writeClosed
+	s.writeClosed = true
+	finished := s.remoteClosed || s.err != nil
+	s.buf.Reset()
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	s.sess.remove(s.id)
+	switch {
+	case !finished:
+		return s.sess.writeFrame(frameReset, s.id, nil)
+	case !writeClosed:
+		return s.sess.writeFrame(frameClose, s.id, nil)
+	}
+	return nil
+}
+
+func (s *stream) LocalAddr() net.Addr {
+	return s.sess.localAddr()
+}
+
+func (s *stream) RemoteAddr() net.Addr {
+	return s.sess.remoteAddr()
+}
+
+// setDeadline sets *deadline to t and arranges for waiters to wake up when it
+// passes.
+func (s *stream) setDeadline(deadline *time.Time, timer **time.Timer, t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	*deadline = t
+	if *timer != nil {
+		(*timer).Stop()
+		*timer = nil
+	}
+	if !t.IsZero() {
+		*timer = time.AfterFunc(time.Until(t), func() {
+			s.mu.Lock()
+			s.cond.Broadcast()
+			s.mu.Unlock()
+		})
+	}
+	s.cond.Broadcast()
+}
+
+func (s *stream) SetReadDeadline(t time.Time) error {
+	s.setDeadline(&s.readDeadline, &s.readTimer, t)
+	return nil
+}
+
+func (s *stream) SetWriteDeadline(t time.Time) error {
+	s.setDeadline(&s.writeDeadline, &s.writeTimer, t)
+	return nil
+}
+
+func (s *stream) SetDeadline(t time.Time) error {
+	s.SetReadDeadline(t)
+	s.SetWriteDeadline(t)
+	return nil
+}
+
+// muxTripper makes each request on a new stream of a session.
+type muxTripper struct {
+	sess *session
+
+	// headerTimeout limits the wait for the headers of each response
+	headerTimeout time.Duration
+	idle          *idleTimer
+}
+
+func (mt *muxTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return mt.roundTrip(req, mt.idle)
+}
+
+func (mt *muxTripper) ping(ctx context.Context) error {
+	resp, err := mt.roundTrip(newHeartbeatRequest(ctx), nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// roundTrip makes a request, which is counted by idle.
+func (mt *muxTripper) roundTrip(req *http.Request, idle *idleTimer) (*http.Response, error) {
+	s, err := mt.sess.open()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrConnectionClosed, err)
+	}
+
+	ctx := req.Context()
+	s.SetDeadline(contextDeadline(ctx))
+	idle.start()
+	stop := watchContext(ctx, s)
+	fail := func(err error) (*http.Response, error) {
+		stop()
+		idle.end()
+		s.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	bw := bufio.NewWriter(s)
+	req.Write(bw)
+	if err := bw.Flush(); err != nil {
+		return fail(err)
+	}
+
+	if mt.headerTimeout > 0 {
+		s.SetReadDeadline(earliest(contextDeadline(ctx),
+			time.Now().Add(mt.headerTimeout)))
+	}
+	br := bufio.NewReader(s)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return fail(err)
+	}
+	if mt.headerTimeout > 0 {
+		s.SetReadDeadline(contextDeadline(ctx))
+		if ctx.Err() != nil {
+			// the deadline set when ctx was done has just been replaced
+			s.SetDeadline(aLongTimeAgo)
+		}
+	}
+
+	// the stream is the body of switch protocols responses, and is closed
+	// with the body of any other response
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		stop()
+		s.SetDeadline(time.Time{})
+		resp.Body = &streamBody{Reader: br, s: s, release: idle.end}
+	} else {
+		resp.Body = &streamBody{Reader: resp.Body, s: s, release: func() {
+			stop()
+			idle.end()
+		}}
+	}
+	return resp, nil
+}
+
+func (mt *muxTripper) Close() error {
+	mt.idle.stop()
+	return mt.sess.Close()
+}
+
+func (mt *muxTripper) Done() <-chan struct{} {
+	return mt.sess.done
+}
+
+// streamBody reads a response body from a stream, writes go to the stream.
+// release, if not nil, is called once the body is closed.
+type streamBody struct {
+	io.Reader
+	s       *stream
+	release func()
+	once    sync.Once
+}
+
+func (sb *streamBody) Write(p []byte) (int, error) {
+	return sb.s.Write(p)
+}
+
+func (sb *streamBody) netConn() net.Conn {
+	return sb.s
+}
+
+func (sb *streamBody) Close() error {
+	err := sb.s.Close()
+	if sb.release != nil {
+		sb.once.Do(sb.release)
+	}
+	return err
+}
+
+// serveMux serves the requests made on the streams of sess with handler,
+// each in its own goroutine, until the session ends.
+func serveMux(ctx context.Context, sess *session, handler http.Handler) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		s, err := sess.accept()
+		if err != nil && ctx.Err() != nil {
+			return ctx.Err()
+		} else if err == io.EOF {
+			// the server has finished with the connection
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			rw := bufio.NewReadWriter(bufio.NewReader(s), bufio.NewWriter(s))
+			if serveConn(ctx, s, rw, handler) != errHijacked {
+				s.Close()
+			}
+		}()
+	}
+}
@@ -0,0 +1,228 @@
+package reversehttp
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newSessionPair() (*session, *session) {
+	c1, c2 := net.Pipe()
+	server := newSession(bufio.NewReader(c1), bufio.NewWriter(c1), c1, c1, true)
+	agent := newSession(bufio.NewReader(c2), bufio.NewWriter(c2), c2, c2, false)
+	return server, agent
+}
+
+func TestSessionStreams(t *testing.T) {
+	server, agent := newSessionPair()
+	defer server.Close()
+	defer agent.Close()
+
+	s1, err := server.open()
+	expect(t, nil, err)
+	expect(t, uint32(1), s1.id)
+	a1, err := agent.accept()
+	expect(t, nil, err)
+	expect(t, uint32(1), a1.id)
+
+	s2, err := server.open()
+	expect(t, nil, err)
+	expect(t, uint32(3), s2.id)
+	a2, err := agent.accept()
+	expect(t, nil, err)
+
+	// streams are independent of each other
+	_, err = s1.Write([]byte("hello"))
+	expect(t, nil, err)
+	_, err = s2.Write([]byte("world"))
+	expect(t, nil, err)
+
+	b := make([]byte, 5)
+	_, err = io.ReadFull(a2, b)
+	expect(t, nil, err)
+	expect(t, "world", string(b))
+
+	// the server does not accept streams, so the agent's are reset
+	s4, err := agent.open()
+	expect(t, nil, err)
+	expect(t, uint32(2), s4.id)
+	_, err = s4.Read(b)
+	expect(t, errStreamReset, err)
+
+	// streams must be opened with the peer's parity
+	expect(t, errProtocol, server.handleFrame(frameOpen, 5, nil))
+	expect(t, errProtocol, agent.handleFrame(frameOpen, 4, nil))
+	expect(t, errProtocol, agent.handleFrame(frameOpen, 0, nil))
+	_, err = io.ReadFull(a1, b)
+	expect(t, nil, err)
+	expect(t, "hello", string(b))
+
+	// half close
+	expect(t, nil, s1.CloseWrite())
+	_, err = a1.Read(b)
+	expect(t, io.EOF, err)
+	_, err = s1.Write(b)
+	expect(t, errStreamClosed, err)
+
+	_, err = a1.Write([]byte("bye"))
+	expect(t, nil, err)
+	expect(t, nil, a1.Close())
+	got, err := ioutil.ReadAll(s1)
+	expect(t, nil, err)
+	expect(t, "bye", string(got))
+	s1.Close()
+
+	// closing a stream the peer is still writing to resets it
+	expect(t, nil, a2.Close())
+	time.Sleep(10 * time.Millisecond)
+	_, err = s2.Write([]byte("more"))
+	expect(t, errStreamReset, err)
+	_, err = s2.Read(b)
+	expect(t, errStreamReset, err)
+
+	// all streams fail with their session
+	s3, err := server.open()
+	expect(t, nil, err)
+	agent.Close()
+	_, err = s3.Read(b)
+	if err == nil {
+		t.Error("read on a closed session succeeded")
+	}
+	_, err = server.open()
+	if err == nil {
+		t.Error("open on a closed session succeeded")
+	}
+	_, err = server.accept()
+	if err == nil {
+		t.Error("accept on a closed session succeeded")
+	}
+}
+
+func TestStreamFlowControl(t *testing.T) {
+	server, agent := newSessionPair()
+	defer server.Close()
+	defer agent.Close()
+
+	s, err := server.open()
+	expect(t, nil, err)
+	a, err := agent.accept()
+	expect(t, nil, err)
+
+	// more than a window, which has to be extended as it is read
+	data := bytes.Repeat([]byte("0123456789abcdef"), streamWindow/4)
+	go func() {
+		_, err := s.Write(data)
+		expect(t, nil, err)
+		s.CloseWrite()
+	}()
+
+	// the writer stops once the window is full, until it is extended
+	buffered := func() int {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		return a.buf.Len()
+	}
+	for i := 0; i < 100 && buffered() < streamWindow; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	expect(t, streamWindow, buffered())
+
+	got, err := ioutil.ReadAll(a)
+	expect(t, nil, err)
+	expect(t, true, bytes.Equal(data, got))
+}
+
+func TestStreamDeadline(t *testing.T) {
+	server, agent := newSessionPair()
+	defer server.Close()
+	defer agent.Close()
+
+	s, err := server.open()
+	expect(t, nil, err)
+
+	s.SetDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err = s.Read(make([]byte, 1))
+	nerr, ok := err.(net.Error)
+	if !ok || !nerr.Timeout() {
+		t.Errorf("expected a timeout, got: %v", err)
+	}
+
+	s.SetDeadline(time.Time{})
+	_, err = s.Write([]byte("hello"))
+	expect(t, nil, err)
+
+	expect(t, server.conn.LocalAddr(), s.LocalAddr())
+	expect(t, server.conn.RemoteAddr(), s.RemoteAddr())
+}
+
+func TestSessionWriteErrorBeforeEOF(t *testing.T) {
+	// a peer that finishes with an HTTP/2 connection closes the request body
+	// pipe, which can fail a write before the read loop sees io.EOF
+	pr, pw := io.Pipe()
+	wr, ww := io.Pipe()
+	wr.Close()
+	sess := newSession(bufio.NewReader(pr), bufio.NewWriter(ww), pr, nil, false)
+
+	expect(t, io.ErrClosedPipe, sess.writeFrame(frameWindow, 2, make([]byte, 4)))
+	expect(t, io.ErrClosedPipe, sess.writeFrame(frameClose, 2, nil))
+	pw.Close()
+	_, err := sess.accept()
+	expect(t, io.EOF, err)
+}
+
+func TestMultiplexedHub(t *testing.T) {
+	hub := new(Hub)
+	connected := watchHub(hub)
+	srv := httptest.NewServer(hub)
+	defer srv.Close()
+
+	// every request waits for all of the others, which only works when they
+	// are served concurrently
+	const n = 10
+	var arrived sync.WaitGroup
+	arrived.Add(n)
+
+	d := &Dialer{
+		Client:    srv.Client(),
+		Header:    http.Header{ClientIDHeader: {"agent"}},
+		Multiplex: true,
+	}
+	resp, result := connectHub(t, d, srv.URL, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived.Done()
+		arrived.Wait()
+		io.Copy(w, r.Body)
+	}))
+	expect(t, true, headerHasToken(resp.Header, "Upgrade", MuxProtocol))
+	<-connected
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			body := bytes.Repeat([]byte("hello world\n"), 10000)
+			resp, err := hub.Client("agent").Post("http://agent/", "text/plain",
+				bytes.NewReader(body))
+			if !expect(t, nil, err) {
+				return
+			}
+			b, err := ioutil.ReadAll(resp.Body)
+			expect(t, nil, err)
+			expect(t, len(body), len(b))
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+
+	hub.Close()
+	<-result
+}
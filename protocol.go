@@ -0,0 +1,45 @@
+package reversehttp
+
+import "net/http"
+
+// The versions of the Reverse HTTP protocol. Clients list the versions they
+// support in the Upgrade header of their upgrade requests, and servers answer
+// with the one they picked.
+const (
+	// PTTH10 is the original protocol, which every peer supports.
+	PTTH10 = "PTTH/1.0"
+
+	// PTTH11 is PTTH/1.0 where the client answers heartbeat requests
+	// itself, rather than passing them to its handler. Servers only send
+	// heartbeats over PTTH/1.1 connections.
+	PTTH11 = "PTTH/1.1"
+)
+
+// protocols lists the supported versions, the preferred ones first.
+var protocols = []string{PTTH11, PTTH10}
+
+// offers lists the supported versions in the order clients send them.
+// PTTH/1.0 comes first, since servers that only know it may only look at the
+// first Upgrade header, and servers that know more pick by their own
+// preference anyway.
+var offers = []string{PTTH10, PTTH11}
+
+// negotiate returns the first of supported that the header name of h lists,
+// or "" if it lists none of them.
+func negotiate(h http.Header, name string, supported []string) string {
+	for _, p := range supported {
+		if headerHasToken(h, name, p) {
+			return p
+		}
+	}
+	return ""
+}
+
+// ResponseProtocol returns the version of the protocol a server picked in its
+// upgrade response resp, or "" if resp is not a Reverse HTTP upgrade response.
+func ResponseProtocol(resp *http.Response) string {
+	if !IsReverseHTTPResponse(resp) {
+		return ""
+	}
+	return negotiate(resp.Header, upgradeHeader(resp.ProtoMajor), protocols)
+}
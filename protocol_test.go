@@ -0,0 +1,109 @@
+package reversehttp
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNegotiate(t *testing.T) {
+	h := http.Header{}
+	h.Add("Upgrade", "ptth/1.1, PTTH/1.0")
+	expect(t, PTTH11, negotiate(h, "Upgrade", protocols))
+	expect(t, PTTH10, negotiate(h, "Upgrade", []string{PTTH10}))
+	expect(t, "", negotiate(h, "Upgrade", []string{"PTTH/2.0"}))
+	expect(t, "", negotiate(h, "Connection", protocols))
+}
+
+func TestProtocolNegotiation(t *testing.T) {
+	tests := []struct {
+		server, client []string
+		expected       string
+	}{
+		{nil, nil, PTTH11},
+		{nil, []string{PTTH10}, PTTH10},
+		{[]string{PTTH10}, nil, PTTH10},
+		{[]string{PTTH10, PTTH11}, nil, PTTH10},
+		{[]string{PTTH11}, []string{PTTH10}, ""},
+	}
+
+	for _, test := range tests {
+		conns := make(chan *ReverseConn, 1)
+		u := &Upgrader{Protocols: test.server}
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c, err := u.Upgrade(w, r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			conns <- c
+		}))
+
+		d := &Dialer{Client: srv.Client(), Protocols: test.client}
+		resp, err := d.Upgrade(context.Background(), srv.URL)
+		if test.expected == "" {
+			expect(t, true, errors.Is(err, ErrUpgradeRejected))
+		} else if expect(t, nil, err) {
+			expect(t, test.expected, ResponseProtocol(resp))
+			c := <-conns
+			expect(t, test.expected, c.Protocol())
+			c.Close()
+			resp.Body.Close()
+		}
+		srv.Close()
+	}
+}
+
+func TestProtocolNotOffered(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Upgrade", PTTH11)
+		w.Header().Set("Connection", "Upgrade")
+		w.WriteHeader(http.StatusSwitchingProtocols)
+	}))
+	defer srv.Close()
+
+	d := &Dialer{Client: srv.Client(), Protocols: []string{PTTH10}}
+	_, err := d.Upgrade(context.Background(), srv.URL)
+	var rejected *UpgradeRejectedError
+	if expect(t, true, errors.As(err, &rejected)) {
+		expect(t, http.StatusSwitchingProtocols, rejected.StatusCode)
+	}
+
+	// agents and listeners check the version too
+	_, _, err = connect(context.Background(), d, srv.URL)
+	expect(t, true, errors.As(err, &rejected))
+}
+
+func TestProtocolHeartbeats(t *testing.T) {
+	// a PTTH/1.0 client that never answers isn't sent heartbeats, so it
+	// isn't disconnected for missing them
+	conns := make(chan *ReverseConn, 1)
+	u := &Upgrader{
+		HeartbeatInterval: 20 * time.Millisecond,
+		HeartbeatMisses:   1,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := u.Upgrade(w, r)
+		expect(t, nil, err)
+		conns <- c
+	}))
+	defer srv.Close()
+
+	d := &Dialer{Client: srv.Client(), Protocols: []string{PTTH10}}
+	resp, err := d.Upgrade(context.Background(), srv.URL)
+	if !expect(t, nil, err) {
+		return
+	}
+	defer resp.Body.Close()
+	c := <-conns
+	defer c.Close()
+
+	select {
+	case <-c.Done():
+		t.Error("PTTH/1.0 connection closed by heartbeats")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
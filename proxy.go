@@ -0,0 +1,104 @@
+package reversehttp
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Proxy is an http.Handler for clients that forwards the server's requests to
+// a local upstream service, and streams its responses back. Hop-by-hop headers
+// are removed, and protocol upgrades such as websockets are supported.
+type Proxy struct {
+	// Upstream is the URL of the service. The path of a request is appended
+	// to its path, and its host is the Host of forwarded requests.
+	Upstream *url.URL
+
+	// Socket, if not empty, is the path of a unix socket the service is
+	// reached through, instead of the host of Upstream.
+	Socket string
+
+	// ErrorLog, if not nil, logs forwarding errors, as for a Gateway.
+	ErrorLog *log.Logger
+
+	once  sync.Once
+	proxy *httputil.ReverseProxy
+}
+
+// NewProxy returns a Proxy to upstream, which is either an http or https URL,
+// or "unix:" followed by the path of a unix socket serving HTTP.
+func NewProxy(upstream string) (*Proxy, error) {
+	if strings.HasPrefix(upstream, "unix:") {
+		return &Proxy{
+			Upstream: &url.URL{Scheme: "http", Host: "localhost"},
+			Socket:   strings.TrimPrefix(upstream, "unix:"),
+		}, nil
+	}
+
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.New("upstream must be an http or https URL")
+	}
+	return &Proxy{Upstream: u}, nil
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.once.Do(func() {
+		transport := &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			MaxIdleConns:    100,
+			IdleConnTimeout: 90 * time.Second,
+		}
+		if p.Socket != "" {
+			transport.Proxy = nil
+			transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", p.Socket)
+			}
+		}
+
+		p.proxy = reverseProxy(p.direct, transport, p.ErrorLog)
+	})
+
+	p.proxy.ServeHTTP(w, r)
+}
+
+// direct rewrites out to be sent to the upstream service.
+func (p *Proxy) direct(out *http.Request) {
+	out.URL.Scheme = p.Upstream.Scheme
+	out.URL.Host = p.Upstream.Host
+	out.URL.Path = singleJoiningSlash(p.Upstream.Path, out.URL.Path)
+	out.URL.RawPath = ""
+	if p.Upstream.RawQuery == "" || out.URL.RawQuery == "" {
+		out.URL.RawQuery = p.Upstream.RawQuery + out.URL.RawQuery
+	} else {
+		out.URL.RawQuery = p.Upstream.RawQuery + "&" + out.URL.RawQuery
+	}
+	out.Host = p.Upstream.Host
+}
+
+// singleJoiningSlash joins two paths with exactly one slash between them.
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
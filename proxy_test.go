@@ -0,0 +1,121 @@
+package reversehttp
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewProxy(t *testing.T) {
+	p, err := NewProxy("http://localhost:8080/app")
+	expect(t, nil, err)
+	expect(t, "localhost:8080", p.Upstream.Host)
+	expect(t, "", p.Socket)
+
+	p, err = NewProxy("unix:/run/app.sock")
+	expect(t, nil, err)
+	expect(t, "/run/app.sock", p.Socket)
+
+	_, err = NewProxy("ftp://localhost/")
+	if err == nil {
+		t.Error("accepted an ftp upstream")
+	}
+}
+
+func TestProxy(t *testing.T) {
+	upstreamHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") == "echo" {
+			conn, rw, err := w.(http.Hijacker).Hijack()
+			if !expect(t, nil, err) {
+				return
+			}
+			defer conn.Close()
+			rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+			rw.Flush()
+			line, _ := rw.ReadString('\n')
+			rw.WriteString(line)
+			rw.Flush()
+			return
+		}
+
+		w.Write([]byte(r.Host + " " + r.URL.Path + " " + r.Header.Get("X-Forwarded-Host") +
+			" " + r.Header.Get("Ptth-Test")))
+	})
+	upstream := httptest.NewServer(upstreamHandler)
+	defer upstream.Close()
+
+	// the same service on a unix socket
+	dir, err := ioutil.TempDir("", "reversehttp")
+	if !expect(t, nil, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "upstream.sock")
+	ul, err := net.Listen("unix", socket)
+	if !expect(t, nil, err) {
+		return
+	}
+	defer ul.Close()
+	go http.Serve(ul, upstreamHandler)
+
+	for _, u := range []string{upstream.URL + "/app", "unix:" + socket} {
+		hub := new(Hub)
+		connected := watchHub(hub)
+		srv := httptest.NewServer(hub)
+
+		p, err := NewProxy(u)
+		if !expect(t, nil, err) {
+			return
+		}
+		d := &Dialer{
+			Client:    srv.Client(),
+			Header:    http.Header{ClientIDHeader: {"agent"}},
+			Multiplex: true,
+		}
+		connectHub(t, d, srv.URL, p)
+		<-connected
+
+		req, err := http.NewRequest("GET", "http://agent.example.com/hello", nil)
+		expect(t, nil, err)
+		req.Header.Set("Ptth-Test", "header")
+		req.Header.Set("Connection", "Ptth-Test")
+		resp, err := hub.Client("agent").Do(req)
+		if expect(t, nil, err) {
+			b, err := ioutil.ReadAll(resp.Body)
+			expect(t, nil, err)
+			resp.Body.Close()
+
+			// hop-by-hop headers are not forwarded
+			expected := p.Upstream.Host + " /app/hello agent.example.com "
+			if p.Socket != "" {
+				expected = "localhost /hello agent.example.com "
+			}
+			expect(t, expected, string(b))
+		}
+
+		// upgrades are proxied
+		req, err = http.NewRequest("GET", "http://agent.example.com/ws", nil)
+		expect(t, nil, err)
+		req.Header.Set("Upgrade", "echo")
+		req.Header.Set("Connection", "Upgrade")
+		resp, err = hub.Conn("agent").RoundTrip(req)
+		if expect(t, nil, err) {
+			expect(t, http.StatusSwitchingProtocols, resp.StatusCode)
+			body := resp.Body.(io.ReadWriteCloser)
+			body.Write([]byte("hello world\n"))
+			line, err := bufio.NewReader(body).ReadString('\n')
+			expect(t, nil, err)
+			expect(t, "hello world\n", line)
+			body.Close()
+		}
+
+		hub.Close()
+		srv.Close()
+	}
+}
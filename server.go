@@ -2,32 +2,46 @@ package reversehttp
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"errors"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // IsReverseHTTPRequest returns true if response is a valid Reverse HTTP
 // upgrade Request (i.e. a valid HTTP/1.1 protocol upgrade request where the
-// Upgrade Header is "PTTH/1.0).  This function will return False otherwise,
-// including when req is nil.
+// Upgrade Header lists a supported version of the protocol, such as
+// "PTTH/1.0"), or an HTTP/2 request whose HTTP2UpgradeHeader does. Tokens are
+// matched in comma-separated lists, across repeated headers and ignoring
+// case. This function will return False otherwise, including when req is
+// nil.
 func IsReverseHTTPRequest(req *http.Request) bool {
 	if req == nil {
 		return false
 	}
 
-	return req.Header.Get("Upgrade") == "PTTH/1.0" &&
-		req.Header.Get("Connection") == "Upgrade"
+	if req.ProtoMajor == 2 {
+		return negotiate(req.Header, HTTP2UpgradeHeader, protocols) != ""
+	}
+	return negotiate(req.Header, "Upgrade", protocols) != "" &&
+		headerHasToken(req.Header, "Connection", "Upgrade")
 }
 
 type upgradeBody struct {
 	rw       *bufio.ReadWriter
 	realBody io.Closer
+	conn     net.Conn
 }
 
-func newUpgradeBody(rw *bufio.ReadWriter, realBody io.Closer) upgradeBody {
-	return upgradeBody{rw, realBody}
+func newUpgradeBody(rw *bufio.ReadWriter, realBody io.Closer, conn net.Conn) upgradeBody {
+	return upgradeBody{rw, realBody, conn}
 }
 
 func (ub upgradeBody) Read(p []byte) (int, error) {
@@ -47,58 +61,622 @@ func (ub upgradeBody) Close() error {
 	return ub.realBody.Close()
 }
 
+func (ub upgradeBody) netConn() net.Conn {
+	return ub.conn
+}
+
+// transport is a connection to a reverse client that requests can be made on.
+type transport interface {
+	http.RoundTripper
+
+	// Close closes the connection, interrupting any requests in progress.
+	Close() error
+
+	// Done is closed once no more requests can be made on the connection.
+	Done() <-chan struct{}
+
+	// ping sends a heartbeat request, unless the connection is busy with
+	// another one.
+	ping(ctx context.Context) error
+}
+
 type ioTripper struct {
-	mu sync.Mutex
-	rw *bufio.ReadWriter
+	mu   sync.Mutex
+	conn net.Conn
+	rw   *bufio.ReadWriter
+	body *ioBody
+	err  error
+
+	// headerTimeout limits the wait for the headers of each response
+	headerTimeout time.Duration
+	idle          *idleTimer
+
+	// active counts the requests made with RoundTrip that are in progress,
+	// including those waiting for the connection
+	active int32
+
+	// heartbeat delivers the result of the heartbeat in progress, if any
+	hbMu      sync.Mutex
+	heartbeat chan error
+
+	doneOnce sync.Once
+	done     chan struct{}
 }
 
-func newIoTripper(rw *bufio.ReadWriter) *ioTripper {
+func newIoTripper(conn net.Conn, rw *bufio.ReadWriter) *ioTripper {
 	return &ioTripper{
-		rw: rw,
+		conn: conn,
+		rw:   rw,
+		done: make(chan struct{}),
 	}
 }
 
 func (it *ioTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&it.active, 1)
 	it.mu.Lock()
 	defer it.mu.Unlock()
 
+	resp, err := it.roundTripLocked(req, it.idle)
+	if err != nil || resp.StatusCode == http.StatusSwitchingProtocols {
+		atomic.AddInt32(&it.active, -1)
+		return resp, err
+	}
+	it.body.request = true
+	return resp, nil
+}
+
+// ping waits for a heartbeat to be answered until ctx is done. A heartbeat
+// that is not answered in time is left in progress, and waited for by the
+// next ping, since the connection can't carry anything else until it is.
+// Nothing is sent while requests are in progress: they keep the connection
+// busy, and whether the client answers them is up to their own timeouts.
+func (it *ioTripper) ping(ctx context.Context) error {
+	it.hbMu.Lock()
+	hb := it.heartbeat
+	if hb == nil {
+		if atomic.LoadInt32(&it.active) > 0 {
+			it.hbMu.Unlock()
+			return nil
+		}
+		hb = make(chan error, 1)
+		it.heartbeat = hb
+		go func() {
+			hb <- it.sendHeartbeat()
+		}()
+	}
+	it.hbMu.Unlock()
+
+	select {
+	case err := <-hb:
+		it.hbMu.Lock()
+		it.heartbeat = nil
+		it.hbMu.Unlock()
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sendHeartbeat makes a heartbeat request, and waits for its response for as
+// long as it takes.
+func (it *ioTripper) sendHeartbeat() error {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	// sending a heartbeat would discard the body the caller is reading
+	if it.body != nil && !it.body.isClosed() {
+		return nil
+	}
+
+	resp, err := it.roundTripLocked(newHeartbeatRequest(context.Background()), nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// roundTripLocked makes a request, which is counted by idle.
+func (it *ioTripper) roundTripLocked(req *http.Request, idle *idleTimer) (*http.Response, error) {
+	if it.err != nil {
+		return nil, it.err
+	}
+	select {
+	case <-it.done:
+		return nil, ErrConnectionClosed
+	default:
+	}
+
+	// the request, including its body, is limited by the deadline of its
+	// context, and interrupted if it is cancelled
+	ctx := req.Context()
+	it.setDeadline(contextDeadline(ctx))
+	idle.start()
+	stop := watchContext(ctx, it.conn)
+	fail := func(err error) (*http.Response, error) {
+		stop()
+		idle.end()
+		it.failLocked()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	// the previous response has to be read to the end before the next one
+	// can be, whatever the caller left unread is discarded
+	if it.body != nil {
+		body := it.body
+		it.body = nil
+		if !body.isClosed() {
+			n, err := io.CopyN(ioutil.Discard, body, maxDrain+1)
+			if err != io.EOF || n > maxDrain {
+				body.Close()
+				return fail(ErrConnectionClosed)
+			}
+		}
+		if err := body.Close(); err != nil {
+			return fail(err)
+		}
+	}
+
 	// write will usually not error, if it does flush will also error
 	req.Write(it.rw)
 	err := it.rw.Flush()
 	if err != nil {
-		return nil, err
+		return fail(err)
 	}
 
+	if it.conn != nil && it.headerTimeout > 0 {
+		it.conn.SetReadDeadline(earliest(contextDeadline(ctx),
+			time.Now().Add(it.headerTimeout)))
+	}
 	resp, err := http.ReadResponse(it.rw.Reader, req)
 	if err != nil {
-		return resp, err
+		return fail(err)
+	}
+	if it.conn != nil && it.headerTimeout > 0 {
+		it.conn.SetReadDeadline(contextDeadline(ctx))
+		if ctx.Err() != nil {
+			// the deadline set when ctx was done has just been replaced
+			it.conn.SetDeadline(aLongTimeAgo)
+		}
 	}
 
-	// provide writable body on switch protocols
+	// provide writable body on switch protocols, the connection belongs to
+	// the caller from now on
 	if resp.StatusCode == http.StatusSwitchingProtocols {
-		resp.Body = newUpgradeBody(it.rw, resp.Body)
+		stop()
+		it.setDeadline(time.Time{})
+		it.idle.stop()
+		resp.Body = newUpgradeBody(it.rw, resp.Body, it.conn)
+		it.err = ErrConnectionClosed
+		it.finish()
+		return resp, nil
+	}
+
+	// the connection is closed once the final body has been consumed
+	closing := resp.Close || req.Close
+	if closing {
+		it.err = ErrConnectionClosed
 	}
-	return resp, err
+	it.body = &ioBody{ReadCloser: resp.Body, it: it, idle: idle, stop: stop,
+		closing: closing}
+	resp.Body = it.body
+	return resp, nil
 }
 
-// ReverseRequest produces an http.Client from an http.ResponseWriter and http.Request.
-// This Client can be used for a single request. It is possible that the
-// connection is kept alive, and the client can be used more than once but this
-// behavior shouldn't be relied on.
-func ReverseRequest(w http.ResponseWriter, r *http.Request) (*http.Client, error) {
+// maxDrain is how much of a response body left unread is discarded before
+// the next request is made. The connection is closed if there is more.
+const maxDrain = 256 << 10
+
+// setDeadline sets the deadline of the connection, if there is one.
+func (it *ioTripper) setDeadline(t time.Time) {
+	if it.conn != nil {
+		it.conn.SetDeadline(t)
+	}
+}
+
+// failLocked marks the connection as unusable and closes it.
+func (it *ioTripper) failLocked() {
+	it.err = ErrConnectionClosed
+	it.Close()
+}
+
+// finish signals that no more requests will be made on the connection.
+func (it *ioTripper) finish() {
+	it.doneOnce.Do(func() {
+		close(it.done)
+	})
+}
+
+func (it *ioTripper) Done() <-chan struct{} {
+	return it.done
+}
+
+// Close closes the underlying connection, interrupting any request in
+// progress.
+func (it *ioTripper) Close() error {
+	var err error
+	if it.conn != nil {
+		err = it.conn.Close()
+	}
+	it.idle.stop()
+	it.finish()
+	return err
+}
+
+// ioBody is the body of a response read by an ioTripper. Closing it ends the
+// request, and closes the connection if no more requests can be made on it.
+type ioBody struct {
+	io.ReadCloser
+	it      *ioTripper
+	idle    *idleTimer
+	stop    func()
+	closing bool
+	once    sync.Once
+	closed  int32
+
+	// request is set when the body ends a request made with RoundTrip
+	request bool
+}
+
+func (b *ioBody) isClosed() bool {
+	return atomic.LoadInt32(&b.closed) != 0
+}
+
+func (b *ioBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		atomic.StoreInt32(&b.closed, 1)
+		if b.request {
+			atomic.AddInt32(&b.it.active, -1)
+		}
+		b.stop()
+		if b.closing {
+			b.it.Close()
+		} else {
+			b.idle.end()
+		}
+	})
+	return err
+}
+
+// Upgrader upgrades Reverse HTTP requests to ReverseConns. The zero value
+// upgrades connections without any timeouts, as Upgrade does.
+//
+// Whatever the timeouts, a request is limited by the deadline of its context,
+// and interrupted if its context is cancelled. Requests that time out fail
+// with a net.Error whose Timeout method returns true.
+type Upgrader struct {
+	// ResponseHeaderTimeout, if not zero, limits the time spent waiting for
+	// the headers of a response once its request has been written. The
+	// connection is closed if it is exceeded.
+	ResponseHeaderTimeout time.Duration
+
+	// IdleTimeout, if not zero, is how long a connection may go without
+	// any request in progress before it is closed. Heartbeats don't count
+	// as requests.
+	IdleTimeout time.Duration
+
+	// HeartbeatInterval, if not zero, is how often a heartbeat request is
+	// sent to the client, to keep the connection alive through NATs and
+	// proxies, and to notice when it has died. Heartbeats are OPTIONS *
+	// requests, which ReverseResponse answers without calling its handler.
+	// They are only sent over PTTH/1.1 connections, since older clients
+	// would pass them to their handler. A connection that isn't multiplexed
+	// only carries heartbeats between other requests.
+	HeartbeatInterval time.Duration
+
+	// Authenticator, if not nil, authenticates clients before their
+	// connections are upgraded, as Authenticate does. Their identity is
+	// kept by their ReverseConn.
+	Authenticator Authenticator
+
+	// Protocols, if not empty, restricts the versions of the protocol the
+	// Upgrader accepts, the preferred ones first. Requests that don't offer
+	// any of them are not Reverse HTTP requests. It defaults to every
+	// supported version, the latest first.
+	Protocols []string
+
+	// HeartbeatMisses is how many heartbeats in a row may go unanswered,
+	// each within HeartbeatInterval, before the connection is closed. It
+	// defaults to 3.
+	HeartbeatMisses int
+}
+
+// defaultHeartbeatMisses is the default of Upgrader.HeartbeatMisses.
+const defaultHeartbeatMisses = 3
+
+// newHeartbeatRequest returns an OPTIONS * request.
+func newHeartbeatRequest(ctx context.Context) *http.Request {
+	req := &http.Request{
+		Method:     "OPTIONS",
+		URL:        &url.URL{Opaque: "*"},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       "ptth",
+	}
+	return req.WithContext(ctx)
+}
+
+// isHeartbeatRequest reports whether req was made by newHeartbeatRequest.
+func isHeartbeatRequest(req *http.Request) bool {
+	return req.Method == "OPTIONS" && req.RequestURI == "*"
+}
+
+// ReverseConn is the server side of an upgraded Reverse HTTP connection. It
+// is an http.RoundTripper that sends requests to the client over the
+// connection.
+type ReverseConn struct {
+	conn     net.Conn
+	req      *http.Request
+	proto    string
+	identity Identity
+	t        transport
+
+	// listeners are those a Hub opened for the services of the client
+	listeners map[string]net.Listener
+
+	// h2 is the connection of an HTTP/2 upgrade, which ends with the
+	// handler that made it
+	h2 *h2Conn
+}
+
+// supported returns the versions of the protocol u accepts, the preferred
+// ones first.
+func (u *Upgrader) supported() []string {
+	if len(u.Protocols) == 0 {
+		return protocols
+	}
+	return u.Protocols
+}
+
+// Upgrade upgrades the Reverse HTTP request r to a ReverseConn, as the zero
+// Upgrader does.
+func Upgrade(w http.ResponseWriter, r *http.Request) (*ReverseConn, error) {
+	return new(Upgrader).Upgrade(w, r)
+}
+
+// Upgrade upgrades the Reverse HTTP request r to a ReverseConn. Requests are
+// sent one at a time over the connection, and any number of them can be made
+// until either side closes the connection or a request fails. Up to 256KiB of
+// a response body that has not been read to the end when the next request is
+// made is discarded, within the deadline of the next request. If there is
+// more, the connection is closed, and the request fails with
+// ErrConnectionClosed.
+//
+// The version of the protocol is the first of u.Protocols that the client
+// offered. If the client also offered MuxProtocol, the connection is
+// multiplexed, and any number of requests can be made concurrently.
+//
+// The upgrade request may be made with any method, and may have a body, which
+// the handler can read before calling Upgrade. Up to 64KiB of what is left of
+// it is discarded, and Upgrade fails if there is more.
+//
+// An HTTP/1.1 connection is hijacked, which may be done through
+// ResponseWriters that wrap the Hijacker and have an Unwrap method. An HTTP/2
+// request is answered with 200 OK, and the connection is then carried by its
+// body and the body of the response: the handler that upgraded it must not
+// return before the connection is done, see ReverseConn.Wait.
+func (u *Upgrader) Upgrade(w http.ResponseWriter, r *http.Request) (*ReverseConn, error) {
 	if !IsReverseHTTPRequest(r) {
-		return nil, errors.New("request is not a valid reverse http request")
+		return nil, ErrNotReverseRequest
+	}
+	upgrade := upgradeHeader(r.ProtoMajor)
+	proto := negotiate(r.Header, upgrade, u.supported())
+	if proto == "" {
+		return nil, ErrNotReverseRequest
 	}
-	w.Header().Add("Upgrade", "PTTH/1.0")
-	w.Header().Add("Connection", "Upgrade")
-	w.WriteHeader(http.StatusSwitchingProtocols)
+	mux := headerHasToken(r.Header, upgrade, MuxProtocol)
 
-	_, buf, err := w.(http.Hijacker).Hijack()
+	var identity Identity
+	if u.Authenticator != nil {
+		var err error
+		identity, err = Authenticate(w, r, u.Authenticator)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var (
+		conn net.Conn
+		buf  *bufio.ReadWriter
+		h2   *h2Conn
+	)
+	if r.ProtoMajor == 2 {
+		// the connection is carried by the request and response bodies
+		f := flusher(w)
+		if f == nil {
+			return nil, ErrHijackUnsupported
+		}
+		w.Header().Add(upgrade, proto)
+		if mux {
+			w.Header().Add(upgrade, MuxProtocol)
+		}
+		w.WriteHeader(http.StatusOK)
+		f.Flush()
+
+		h2 = newH2Conn(w, f, r)
+		conn = h2
+		buf = bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	} else {
+		hijacker := hijacker(w)
+		if hijacker == nil {
+			return nil, ErrHijackUnsupported
+		}
+		// whatever is left of the body would be read as the first response
+		if err := discardBody(r); err != nil {
+			return nil, err
+		}
+		w.Header().Add(upgrade, proto)
+		if mux {
+			w.Header().Add(upgrade, MuxProtocol)
+		}
+		w.Header().Add("Connection", "Upgrade")
+		w.WriteHeader(http.StatusSwitchingProtocols)
+
+		var err error
+		conn, buf, err = hijacker.Hijack()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	c := &ReverseConn{
+		conn:     conn,
+		req:      r,
+		proto:    proto,
+		identity: identity,
+		h2:       h2,
+	}
+	if mux {
+		mt := &muxTripper{
+			sess:          newSession(buf.Reader, buf.Writer, conn, conn, true),
+			headerTimeout: u.ResponseHeaderTimeout,
+		}
+		mt.idle = newIdleTimer(u.IdleTimeout, mt.Close)
+		c.t = mt
+	} else {
+		it := newIoTripper(conn, buf)
+		it.headerTimeout = u.ResponseHeaderTimeout
+		it.idle = newIdleTimer(u.IdleTimeout, it.Close)
+		c.t = it
+	}
+
+	if u.HeartbeatInterval > 0 && proto != PTTH10 {
+		misses := u.HeartbeatMisses
+		if misses <= 0 {
+			misses = defaultHeartbeatMisses
+		}
+		go c.heartbeat(u.HeartbeatInterval, misses)
+	}
+	return c, nil
+}
+
+// maxUpgradeBody is how much of the body of an upgrade request is discarded
+// before the connection is upgraded.
+const maxUpgradeBody = 64 << 10
+
+// errUpgradeBodyTooLarge is returned by Upgrade when the body of the upgrade
+// request is longer than maxUpgradeBody.
+var errUpgradeBodyTooLarge = errors.New("upgrade request body is too large")
+
+// discardBody reads the body of the upgrade request r to the end.
+func discardBody(r *http.Request) error {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil
+	}
+	n, err := io.Copy(ioutil.Discard, io.LimitReader(r.Body, maxUpgradeBody+1))
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if n > maxUpgradeBody {
+		return errUpgradeBodyTooLarge
 	}
+	return nil
+}
+
+// heartbeat pings the client every interval until the connection is done,
+// and closes the connection once misses pings in a row have failed.
+func (c *ReverseConn) heartbeat(interval time.Duration, misses int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	missed := 0
+	for {
+		select {
+		case <-c.Done():
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		err := c.t.ping(ctx)
+		cancel()
+		if err == nil {
+			missed = 0
+			continue
+		}
+
+		missed++
+		if missed >= misses {
+			c.Close()
+			return
+		}
+	}
+}
+
+// RoundTrip sends req to the client and returns its response.
+func (c *ReverseConn) RoundTrip(req *http.Request) (*http.Response, error) {
+	return c.t.RoundTrip(req)
+}
 
+// Client returns an http.Client that sends its requests over c.
+func (c *ReverseConn) Client() *http.Client {
 	return &http.Client{
-		Transport: newIoTripper(buf),
-	}, nil
+		Transport: c,
+	}
+}
+
+// Request returns the upgrade request the connection was made with.
+func (c *ReverseConn) Request() *http.Request {
+	return c.req
+}
+
+// Identity returns the identity of the client, as established by the
+// Authenticator of the Upgrader or Hub that accepted it. It is the zero
+// Identity, but for the ID a Hub gave the client, if there was none.
+func (c *ReverseConn) Identity() Identity {
+	return c.identity
+}
+
+// Protocol returns the version of the protocol negotiated with the client,
+// such as PTTH10.
+func (c *ReverseConn) Protocol() string {
+	return c.proto
+}
+
+// RemoteAddr returns the network address of the client.
+func (c *ReverseConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// TLS returns the state of the TLS connection the upgrade request was
+// received on, or nil if it was not received over TLS.
+func (c *ReverseConn) TLS() *tls.ConnectionState {
+	return c.req.TLS
+}
+
+// Close closes the connection, interrupting any requests in progress.
+func (c *ReverseConn) Close() error {
+	return c.t.Close()
+}
+
+// Wait waits for the connection to be done. It also waits for the upgraded
+// body of a switch protocols response made over an HTTP/2 connection to be
+// closed, since such a connection ends with the handler that upgraded it.
+func (c *ReverseConn) Wait() {
+	<-c.Done()
+	if c.h2 != nil {
+		c.h2.wait()
+	}
+}
+
+// Done returns a channel that is closed once no more requests can be made
+// over the connection.
+func (c *ReverseConn) Done() <-chan struct{} {
+	return c.t.Done()
+}
+
+// ReverseRequest produces an http.Client from an http.ResponseWriter and
+// http.Request, by upgrading the connection as Upgrade does.
+func ReverseRequest(w http.ResponseWriter, r *http.Request) (*http.Client, error) {
+	c, err := Upgrade(w, r)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Client(), nil
 }
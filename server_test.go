@@ -3,6 +3,8 @@ package reversehttp
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
 	"io"
 	"io/ioutil"
@@ -11,6 +13,7 @@ import (
 	"net/http/httptest"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestIsReverseHTTPRequest(t *testing.T) {
@@ -26,6 +29,25 @@ func TestIsReverseHTTPRequest(t *testing.T) {
 		Header: h,
 	}))
 
+	h = http.Header{}
+	h.Add("Upgrade", "websocket")
+	h.Add("Upgrade", " ptth/1.0 , h2c")
+	h.Add("Connection", "keep-alive, upgrade")
+	expect(t, true, IsReverseHTTPRequest(&http.Request{
+		Header: h,
+	}))
+
+	h.Set("Connection", "keep-alive, upgraded")
+	expect(t, false, IsReverseHTTPRequest(&http.Request{
+		Header: h,
+	}))
+
+	h.Set("Connection", "Upgrade")
+	h.Set("Upgrade", "PTTH/1.01")
+	expect(t, false, IsReverseHTTPRequest(&http.Request{
+		Header: h,
+	}))
+
 	expect(t, false, IsReverseHTTPRequest(nil))
 }
 
@@ -51,7 +73,7 @@ func (ew errorWriter) Read(p []byte) (n int, err error) {
 func TestUpgradeBodyRead(t *testing.T) {
 	var buf bytes.Buffer
 	buf.Write([]byte("hello world\n"))
-	ub := newUpgradeBody(bufio.NewReadWriter(bufio.NewReader(&buf), nil), nil)
+	ub := newUpgradeBody(bufio.NewReadWriter(bufio.NewReader(&buf), nil), nil, nil)
 
 	b, err := ioutil.ReadAll(ub)
 	expect(t, nil, err)
@@ -60,7 +82,7 @@ func TestUpgradeBodyRead(t *testing.T) {
 
 func TestUpgradeBodyWrite(t *testing.T) {
 	var buf bytes.Buffer
-	ub := newUpgradeBody(bufio.NewReadWriter(nil, bufio.NewWriter(&buf)), nil)
+	ub := newUpgradeBody(bufio.NewReadWriter(nil, bufio.NewWriter(&buf)), nil, nil)
 
 	n, err := ub.Write([]byte("hello world\n"))
 	expect(t, 12, n)
@@ -71,13 +93,13 @@ func TestUpgradeBodyWrite(t *testing.T) {
 	expect(t, nil, err)
 	expect(t, "hello world\n", string(b))
 
-	ub = newUpgradeBody(bufio.NewReadWriter(nil, bufio.NewWriter(errorWriter{true, true})), nil)
+	ub = newUpgradeBody(bufio.NewReadWriter(nil, bufio.NewWriter(errorWriter{true, true})), nil, nil)
 	_, err = ub.Write([]byte("hello world\n"))
 	if err == nil {
 		t.Error("write did not fail")
 	}
 
-	ub = newUpgradeBody(bufio.NewReadWriter(nil, bufio.NewWriterSize(errorWriter{true, true}, 1)), nil)
+	ub = newUpgradeBody(bufio.NewReadWriter(nil, bufio.NewWriterSize(errorWriter{true, true}, 1)), nil, nil)
 	_, err = ub.Write([]byte("hello world\n"))
 	if err == nil {
 		t.Error("write did not fail")
@@ -95,7 +117,7 @@ func (cc *closeChecker) Close() error {
 
 func TestUpgradeBodyClose(t *testing.T) {
 	cc := closeChecker{false}
-	ub := newUpgradeBody(nil, &cc)
+	ub := newUpgradeBody(nil, &cc, nil)
 
 	err := ub.Close()
 	expect(t, nil, err)
@@ -103,7 +125,7 @@ func TestUpgradeBodyClose(t *testing.T) {
 }
 
 func TestIoTripper(t *testing.T) {
-	it := newIoTripper(bufio.NewReadWriter(bufio.NewReader(errorWriter{true, true}), bufio.NewWriter(errorWriter{true, true})))
+	it := newIoTripper(nil, bufio.NewReadWriter(bufio.NewReader(errorWriter{true, true}), bufio.NewWriter(errorWriter{true, true})))
 
 	r, err := http.NewRequest("GET", "http://example.com/path", nil)
 	if err != nil {
@@ -115,7 +137,7 @@ func TestIoTripper(t *testing.T) {
 		t.Error()
 	}
 
-	it = newIoTripper(bufio.NewReadWriter(bufio.NewReader(errorWriter{true, true}), bufio.NewWriter(errorWriter{false, false})))
+	it = newIoTripper(nil, bufio.NewReadWriter(bufio.NewReader(errorWriter{true, true}), bufio.NewWriter(errorWriter{false, false})))
 	_, err = it.RoundTrip(r)
 	if err == nil {
 		t.Error()
@@ -125,7 +147,7 @@ func TestIoTripper(t *testing.T) {
 	rbuf := new(bytes.Buffer)
 	wbuf := new(bytes.Buffer)
 	rbuf.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: test\r\nConnection: Upgrade\r\n\r\nhello world\n"))
-	it = newIoTripper(bufio.NewReadWriter(bufio.NewReader(rbuf), bufio.NewWriter(wbuf)))
+	it = newIoTripper(nil, bufio.NewReadWriter(bufio.NewReader(rbuf), bufio.NewWriter(wbuf)))
 
 	resp, err := it.RoundTrip(r)
 	expect(t, nil, err)
@@ -133,6 +155,98 @@ func TestIoTripper(t *testing.T) {
 	expect(t, "reversehttp.upgradeBody", reflect.TypeOf(resp.Body).String())
 }
 
+func TestIoTripperReuse(t *testing.T) {
+	rbuf := new(bytes.Buffer)
+	wbuf := new(bytes.Buffer)
+	rbuf.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 12\r\n\r\nhello world\n"))
+	rbuf.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhullo"))
+	rbuf.Write([]byte("HTTP/1.1 200 OK\r\nConnection: close\r\nContent-Length: 5\r\n\r\nwerld"))
+	it := newIoTripper(nil, bufio.NewReadWriter(bufio.NewReader(rbuf), bufio.NewWriter(wbuf)))
+
+	r, err := http.NewRequest("GET", "http://example.com/path", nil)
+	expect(t, nil, err)
+
+	// the first body is only partially read, it has to be skipped
+	resp, err := it.RoundTrip(r)
+	expect(t, nil, err)
+	b := make([]byte, 5)
+	_, err = io.ReadFull(resp.Body, b)
+	expect(t, nil, err)
+	expect(t, "hello", string(b))
+
+	resp, err = it.RoundTrip(r)
+	expect(t, nil, err)
+	b, err = ioutil.ReadAll(resp.Body)
+	expect(t, nil, err)
+	expect(t, "hullo", string(b))
+	resp.Body.Close()
+
+	resp, err = it.RoundTrip(r)
+	expect(t, nil, err)
+	expect(t, true, resp.Close)
+	b, err = ioutil.ReadAll(resp.Body)
+	expect(t, nil, err)
+	expect(t, "werld", string(b))
+
+	// the server asked to close the connection
+	_, err = it.RoundTrip(r)
+	expect(t, ErrConnectionClosed, err)
+
+	// a failed exchange leaves the connection unusable
+	it = newIoTripper(nil, bufio.NewReadWriter(bufio.NewReader(errorWriter{true, true}), bufio.NewWriter(errorWriter{false, false})))
+	_, err = it.RoundTrip(r)
+	if err == nil || err == ErrConnectionClosed {
+		t.Error()
+	}
+	_, err = it.RoundTrip(r)
+	expect(t, ErrConnectionClosed, err)
+}
+
+func TestIoTripperAbandonedBody(t *testing.T) {
+	conns := make(chan *ReverseConn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := Upgrade(w, r)
+		expect(t, nil, err)
+		conns <- c
+	}))
+	defer srv.Close()
+
+	d := &Dialer{Client: srv.Client()}
+	go d.Reverse(context.Background(), srv.URL, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for r.Context().Err() == nil {
+			w.Write([]byte("data: tick\n\n"))
+			w.(http.Flusher).Flush()
+			time.Sleep(time.Millisecond)
+		}
+	}))
+	c := <-conns
+	defer c.Close()
+
+	// an endless body that is left unread can't be drained, so the next
+	// request fails within its deadline
+	resp, err := c.Client().Get("http://example.com/events")
+	if !expect(t, nil, err) {
+		return
+	}
+	b := make([]byte, 12)
+	_, err = io.ReadFull(resp.Body, b)
+	expect(t, nil, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	start := time.Now()
+	_, err = c.RoundTrip(req.WithContext(ctx))
+	expect(t, true, err != nil)
+	expect(t, true, time.Since(start) < time.Second)
+
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second):
+		t.Error("connection is not done after a failed drain")
+	}
+}
+
 type ResponseHijackFailer struct {
 	http.ResponseWriter
 }
@@ -197,3 +311,212 @@ func TestReverseRequest(t *testing.T) {
 
 	<-endserver
 }
+
+func TestUpgrade(t *testing.T) {
+	conns := make(chan *ReverseConn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := Upgrade(w, httptest.NewRequest("GET", "/", nil))
+		if err == nil {
+			t.Error("upgraded a request that is not a reverse http request")
+		}
+
+		c, err := Upgrade(w, r)
+		expect(t, nil, err)
+		conns <- c
+	}))
+	defer srv.Close()
+
+	resp, err := (&Dialer{Client: srv.Client()}).Upgrade(context.Background(), srv.URL)
+	if !expect(t, nil, err) {
+		return
+	}
+	result := make(chan error, 1)
+	go func() {
+		result <- ReverseResponse(resp, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("hello world\n"))
+		}))
+	}()
+
+	c := <-conns
+	expect(t, "POST", c.Request().Method)
+	expect(t, (*tls.ConnectionState)(nil), c.TLS())
+	if c.RemoteAddr() == nil {
+		t.Error("connection has no remote address")
+	}
+
+	resp, err = c.Client().Get("http://example.com/")
+	if expect(t, nil, err) {
+		b, err := ioutil.ReadAll(resp.Body)
+		expect(t, nil, err)
+		expect(t, "hello world\n", string(b))
+	}
+
+	select {
+	case <-c.Done():
+		t.Error("connection is done before it is closed")
+	default:
+	}
+	c.Close()
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second):
+		t.Error("connection is not done after it is closed")
+	}
+	<-result
+}
+
+func TestUpgraderTimeouts(t *testing.T) {
+	for _, multiplex := range []bool{false, true} {
+		conns := make(chan *ReverseConn, 1)
+		u := &Upgrader{
+			ResponseHeaderTimeout: 50 * time.Millisecond,
+			IdleTimeout:           100 * time.Millisecond,
+		}
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c, err := u.Upgrade(w, r)
+			expect(t, nil, err)
+			conns <- c
+		}))
+
+		release := make(chan struct{})
+		d := &Dialer{Client: srv.Client(), Multiplex: multiplex}
+		go d.Reverse(context.Background(), srv.URL, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/hang" {
+				<-release
+			}
+			w.Write([]byte("hello world\n"))
+		}))
+		c := <-conns
+
+		// an answered request keeps the connection open for the idle timeout
+		resp, err := c.Client().Get("http://example.com/")
+		if expect(t, nil, err) {
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+
+		if multiplex {
+			// a stream can time out without affecting the others
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			req, _ := http.NewRequest("GET", "http://example.com/hang", nil)
+			_, err = c.Client().Do(req.WithContext(ctx))
+			cancel()
+			nerr, ok := err.(net.Error)
+			expect(t, true, ok && nerr.Timeout())
+
+			_, err = c.Client().Get("http://example.com/hang")
+			nerr, ok = err.(net.Error)
+			expect(t, true, ok && nerr.Timeout())
+		} else {
+			_, err = c.Client().Get("http://example.com/hang")
+			nerr, ok := err.(net.Error)
+			expect(t, true, ok && nerr.Timeout())
+		}
+		close(release)
+
+		select {
+		case <-c.Done():
+		case <-time.After(time.Second):
+			t.Error("idle connection was not closed")
+		}
+		srv.Close()
+	}
+}
+
+func TestHeartbeatSlowRequest(t *testing.T) {
+	conns := make(chan *ReverseConn, 1)
+	u := &Upgrader{HeartbeatInterval: 50 * time.Millisecond}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := u.Upgrade(w, r)
+		expect(t, nil, err)
+		conns <- c
+	}))
+	defer srv.Close()
+
+	d := &Dialer{Client: srv.Client()}
+	go d.Reverse(context.Background(), srv.URL, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(300 * time.Millisecond)
+		}
+		w.Write([]byte("hello world\n"))
+	}))
+	c := <-conns
+	defer c.Close()
+
+	// a request that outlasts several heartbeat intervals neither counts as
+	// missed heartbeats nor breaks the connection
+	slow := make(chan struct{})
+	go func() {
+		defer close(slow)
+		resp, err := c.Client().Get("http://example.com/slow")
+		if expect(t, nil, err) {
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+	}()
+
+	// heartbeats are skipped rather than waiting for it
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	expect(t, nil, c.t.ping(ctx))
+	expect(t, nil, ctx.Err())
+	cancel()
+	<-slow
+
+	resp, err := c.Client().Get("http://example.com/")
+	if expect(t, nil, err) {
+		b, err := ioutil.ReadAll(resp.Body)
+		expect(t, nil, err)
+		expect(t, "hello world\n", string(b))
+		resp.Body.Close()
+	}
+
+	// heartbeats go on once it is done
+	time.Sleep(200 * time.Millisecond)
+	select {
+	case <-c.Done():
+		t.Error("connection closed by heartbeats")
+	default:
+	}
+}
+
+func TestHeartbeatLate(t *testing.T) {
+	conns := make(chan *ReverseConn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := Upgrade(w, r)
+		expect(t, nil, err)
+		conns <- c
+	}))
+	defer srv.Close()
+
+	// the client answers by hand, too late for the first ping
+	d := &Dialer{Client: srv.Client()}
+	resp, err := d.Upgrade(context.Background(), srv.URL)
+	if !expect(t, nil, err) {
+		return
+	}
+	defer resp.Body.Close()
+	c := <-conns
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	expect(t, context.DeadlineExceeded, c.t.ping(ctx))
+	cancel()
+
+	// a missed heartbeat leaves the connection open
+	br := bufio.NewReader(resp.Body)
+	req, err := http.ReadRequest(br)
+	if expect(t, nil, err) {
+		expect(t, true, isHeartbeatRequest(req))
+	}
+	resp.Body.(io.Writer).Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"))
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	expect(t, nil, c.t.ping(ctx))
+	cancel()
+	select {
+	case <-c.Done():
+		t.Error("connection closed by a late heartbeat")
+	default:
+	}
+}
@@ -0,0 +1,120 @@
+package reversehttp
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// aLongTimeAgo is a deadline in the past, setting it interrupts any read or
+// write in progress.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// contextDeadline returns the deadline of ctx, or the zero time if it has
+// none.
+func contextDeadline(ctx context.Context) time.Time {
+	t, _ := ctx.Deadline()
+	return t
+}
+
+// earliest returns the earliest of two deadlines, where the zero time means
+// no deadline.
+func earliest(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+	return a
+}
+
+// watchContext interrupts the reads and writes on conn once ctx is done,
+// until stop is called. conn is not touched after stop returns.
+func watchContext(ctx context.Context, conn net.Conn) (stop func()) {
+	if conn == nil || ctx.Done() == nil {
+		return func() {}
+	}
+
+	stopc := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(aLongTimeAgo)
+		case <-stopc:
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(stopc)
+			<-exited
+		})
+	}
+}
+
+// idleTimer calls close once no request has been in progress for timeout. A
+// nil *idleTimer does nothing.
+type idleTimer struct {
+	mu      sync.Mutex
+	timeout time.Duration
+	active  int
+	timer   *time.Timer
+}
+
+// newIdleTimer returns an idleTimer that is already counting, or nil if
+// timeout is not positive.
+func newIdleTimer(timeout time.Duration, close func() error) *idleTimer {
+	if timeout <= 0 {
+		return nil
+	}
+
+	return &idleTimer{
+		timeout: timeout,
+		timer: time.AfterFunc(timeout, func() {
+			close()
+		}),
+	}
+}
+
+// start marks the beginning of a request.
+func (t *idleTimer) start() {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.active++
+	t.timer.Stop()
+}
+
+// end marks the end of a request started with start.
+func (t *idleTimer) end() {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.active--
+	if t.active == 0 {
+		t.timer.Reset(t.timeout)
+	}
+}
+
+// stop stops the timer for good.
+func (t *idleTimer) stop() {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.active = -1
+	t.timer.Stop()
+}